@@ -0,0 +1,168 @@
+// Copyright (C) 2015  Mark Canning
+// Author: Argusdusty (Mark Canning)
+// Email: argusdusty@gmail.com
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package indexed implements an indexed priority queue, in which each item
+// has a unique key by which it can be found, updated and removed.
+// Each operation is O(log n). A Queue is self-contained: it keeps its own
+// heap, rather than implementing heap.Interface for use with container/heap.
+package indexed
+
+import (
+	"cmp"
+	"container/heap"
+)
+
+// An item of a queue
+type Item[K comparable, V any, P any] struct {
+	Key      K
+	Value    V
+	Priority P
+}
+
+// Indexed priority queue, where items with equal priorities are
+// popped in the order they were pushed. Use its methods rather than
+// container/heap. Not safe for concurrent use.
+type Queue[K comparable, V any, P any] struct {
+	heap  entries[K, V, P]
+	index map[K]*entry[K, V, P] // Map from each key to its entry
+	seq   uint64                // Sequence number of the next pushed item
+}
+
+type entry[K comparable, V any, P any] struct {
+	item  Item[K, V, P]
+	index int    // Index of the entry in the heap
+	seq   uint64 // Order in which the item was pushed
+}
+
+// Entries of a queue, as a heap.Interface
+type entries[K comparable, V any, P any] struct {
+	list []*entry[K, V, P]
+	less func(a, b P) bool
+}
+
+func (h *entries[K, V, P]) Len() int { return len(h.list) }
+
+func (h *entries[K, V, P]) Less(i, j int) bool {
+	a, b := h.list[i], h.list[j]
+	if h.less(a.item.Priority, b.item.Priority) {
+		return true
+	}
+	if h.less(b.item.Priority, a.item.Priority) {
+		return false
+	}
+	return a.seq < b.seq
+}
+
+func (h *entries[K, V, P]) Swap(i, j int) {
+	h.list[i], h.list[j] = h.list[j], h.list[i]
+	h.list[i].index = i
+	h.list[j].index = j
+}
+
+func (h *entries[K, V, P]) Push(x any) {
+	e := x.(*entry[K, V, P])
+	e.index = len(h.list)
+	h.list = append(h.list, e)
+}
+
+func (h *entries[K, V, P]) Pop() any {
+	n := len(h.list) - 1
+	e := h.list[n]
+	h.list[n] = nil
+	h.list = h.list[:n]
+	return e
+}
+
+// Returns a new queue where smaller priorities are popped first
+func New[K comparable, V any, P cmp.Ordered]() *Queue[K, V, P] {
+	return NewFunc[K, V](cmp.Less[P])
+}
+
+// Returns a new queue ordered by less, which reports whether
+// priority a is popped before priority b
+func NewFunc[K comparable, V any, P any](less func(a, b P) bool) *Queue[K, V, P] {
+	return &Queue[K, V, P]{heap: entries[K, V, P]{less: less}, index: make(map[K]*entry[K, V, P])}
+}
+
+// Number of items in the queue
+func (Q *Queue[K, V, P]) Len() int {
+	return len(Q.heap.list)
+}
+
+// Push an item, unless an item with the key is already in the queue.
+// Returns whether the item was pushed.
+func (Q *Queue[K, V, P]) Push(key K, value V, priority P) bool {
+	if _, ok := Q.index[key]; ok {
+		return false
+	}
+	e := &entry[K, V, P]{item: Item[K, V, P]{key, value, priority}, seq: Q.seq}
+	Q.seq++
+	heap.Push(&Q.heap, e)
+	Q.index[key] = e
+	return true
+}
+
+// Remove and return the first item, or false if the queue is empty
+func (Q *Queue[K, V, P]) Pop() (Item[K, V, P], bool) {
+	if len(Q.heap.list) == 0 {
+		return Item[K, V, P]{}, false
+	}
+	e := heap.Pop(&Q.heap).(*entry[K, V, P])
+	delete(Q.index, e.item.Key)
+	return e.item, true
+}
+
+// Return the first item without removing it, or false if the queue is empty
+func (Q *Queue[K, V, P]) Peek() (Item[K, V, P], bool) {
+	if len(Q.heap.list) == 0 {
+		return Item[K, V, P]{}, false
+	}
+	return Q.heap.list[0].item, true
+}
+
+// Return the item with the key, or false if there is none
+func (Q *Queue[K, V, P]) Get(key K) (Item[K, V, P], bool) {
+	e, ok := Q.index[key]
+	if !ok {
+		return Item[K, V, P]{}, false
+	}
+	return e.item, true
+}
+
+// Remove and return the item with the key, or false if there is none
+func (Q *Queue[K, V, P]) Remove(key K) (Item[K, V, P], bool) {
+	e, ok := Q.index[key]
+	if !ok {
+		return Item[K, V, P]{}, false
+	}
+	heap.Remove(&Q.heap, e.index)
+	delete(Q.index, key)
+	return e.item, true
+}
+
+// Set the value and priority of the item with the key. The item keeps its
+// place among items of equal priority. Returns false if there is no item.
+func (Q *Queue[K, V, P]) Update(key K, value V, priority P) bool {
+	e, ok := Q.index[key]
+	if !ok {
+		return false
+	}
+	e.item.Value = value
+	e.item.Priority = priority
+	heap.Fix(&Q.heap, e.index)
+	return true
+}
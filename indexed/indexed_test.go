@@ -0,0 +1,119 @@
+// Copyright (C) 2015  Mark Canning
+// Author: Argusdusty (Mark Canning)
+// Email: argusdusty@gmail.com
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package indexed
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	Q := New[string, int, int]()
+	if _, ok := Q.Pop(); ok {
+		t.Error("Expected nothing to pop from an empty queue")
+	}
+	for i, p := range []int{3, 1, 2, 1, 0} {
+		Q.Push(strconv.Itoa(i), i, p)
+	}
+	if Q.Push("0", 0, 0) {
+		t.Error("Expected a duplicate key not to be pushed")
+	}
+	if item, ok := Q.Peek(); !ok || item.Key != "4" {
+		t.Error("Unexpected first item:", item)
+	}
+	Q.Update("0", 10, 1)
+	if item, ok := Q.Remove("2"); !ok || item.Value != 2 {
+		t.Error("Unexpected removed item:", item)
+	}
+	if Q.Len() != 4 {
+		t.Error("Expected 4 items, got:", Q.Len())
+	}
+	var order []string
+	for item, ok := Q.Pop(); ok; item, ok = Q.Pop() {
+		order = append(order, item.Key)
+	}
+	// Equal priorities are popped in the order they were pushed
+	if fmt.Sprint(order) != "[4 0 1 3]" {
+		t.Error("Unexpected order:", order)
+	}
+}
+
+func TestQueueMissing(t *testing.T) {
+	Q := New[string, int, int]()
+	if _, ok := Q.Peek(); ok {
+		t.Error("Expected nothing to peek in an empty queue")
+	}
+	Q.Push("a", 1, 1)
+	if _, ok := Q.Remove("b"); ok {
+		t.Error("Expected no item to remove")
+	}
+	if Q.Update("b", 2, 0) {
+		t.Error("Expected no item to update")
+	}
+	if _, ok := Q.Get("b"); ok {
+		t.Error("Expected no item to get")
+	}
+	if item, ok := Q.Peek(); !ok || item.Key != "a" || item.Priority != 1 || Q.Len() != 1 {
+		t.Error("Unexpected first item:", item)
+	}
+	Q.Pop()
+	if _, ok := Q.Peek(); ok {
+		t.Error("Expected nothing to peek once the queue is emptied")
+	}
+}
+
+func TestQueueTies(t *testing.T) {
+	Q := NewFunc[string, int](func(a, b int) bool { return a > b })
+	for i := 0; i < 6; i++ {
+		Q.Push(strconv.Itoa(i), i, 1)
+	}
+	// Updating to the same priority, or removing others, keeps the order
+	Q.Update("1", 10, 1)
+	Q.Remove("3")
+	Q.Update("4", 4, 2)
+	var order []string
+	for item, ok := Q.Pop(); ok; item, ok = Q.Pop() {
+		order = append(order, item.Key)
+	}
+	if fmt.Sprint(order) != "[4 0 1 2 5]" {
+		t.Error("Unexpected order:", order)
+	}
+	// A key can be pushed again once popped, after the items already waiting
+	Q.Push("a", 0, 1)
+	Q.Push("b", 0, 1)
+	Q.Pop()
+	Q.Push("a", 0, 1)
+	order = nil
+	for item, ok := Q.Pop(); ok; item, ok = Q.Pop() {
+		order = append(order, item.Key)
+	}
+	if fmt.Sprint(order) != "[b a]" {
+		t.Error("Unexpected order:", order)
+	}
+}
+
+func BenchmarkQueuePushPop(b *testing.B) {
+	Q := New[int, int, int]()
+	for i := 0; i < b.N; i++ {
+		Q.Push(i, i, i%100)
+	}
+	for Q.Len() > 0 {
+		Q.Pop()
+	}
+}
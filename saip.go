@@ -18,230 +18,1369 @@
 package sapip
 
 import (
+	"cmp"
+	"context"
+	"iter"
 	"sync"
+	"time"
 )
 
-type SAIPQueue struct {
-	lock         *sync.Mutex // Global lock
-	execLock     *sync.Mutex // Lock for manipulating execElements
-	waitCond     *sync.Cond  // Wait for queue to be non-empty and open slot in execElements
-	elements     IndexedPriorityElements
-	execElements []*PriorityElement
-	limit        int
-	function     QueueFunction
-	closed       bool
-	stopped      bool
-	errFunc      QueueErrFunction
+type SAIPQueueOf[P comparable] struct {
+	lock              *sync.Mutex // Global lock
+	execLock          *sync.Mutex // Lock for manipulating execElements
+	waitCond          *sync.Cond  // Wait for queue to be non-empty and open slot in execElements
+	elements          IndexedPriorityElementsOf[P]
+	execElements      []*PriorityElementOf[P]
+	limit             int
+	function          QueueJobFunction
+	itemFunc          QueueItemFunction // Returns the result of each data item, if set
+	batchFunc         QueueJobFunction  // Executes elements in batches, if set
+	jobs              bool              // Whether a job function has been set, so each add call has its own result
+	batchSize         int
+	batch             []*PriorityElementOf[P] // Batch being collected for dispatch
+	execBatches       int                     // Number of executing batches
+	closed            bool
+	state             State
+	changed           chan struct{} // Closed and replaced on each change of state
+	looping           bool          // Whether a Run loop is active
+	errFunc           QueueErrFunction
+	maxWait           time.Duration             // Elements waiting longer than this are promoted ahead of priority order
+	deadline          func(p P) time.Time       // Deadline of each priority, if deadlines are tracked
+	missFunc          QueueDeadlineMissFunction // Called on each element which finishes after its deadline
+	deadlineStats     DeadlineStats
+	reserved          int // Number of slots reserved for priorities at or before reservedFor
+	reservedFor       P
+	preempt           func(waiting, running P) bool // Whether a waiting element should preempt a running element
+	preemptedElements []*PriorityElementOf[P]       // Preempted elements which have not yet returned
+	capacity          int                           // Maximum number of waiting elements, or 0 for no maximum
+	fullPolicy        FullPolicy
+	byteBudget        int // Maximum total size in bytes of waiting data, or 0 for no maximum
+	elementBudget     int // Maximum size in bytes of the data of each waiting element, or 0 for no maximum
+	budgetPolicy      FullPolicy
+	linger            func(name string) Linger // How long each element waits for more data, if set
+	lingerUntil       time.Time                // When the first lingering element can execute
+	lingerTimer       *time.Timer              // Wakes the queue once lingering elements can execute
+	report            *ShutdownReport          // Report of the shutdown in progress, if any
+	dropAbandoned     bool                     // Whether elements are removed once all of their waiters have gone
+	completions       []*completions           // Collect results for iterators over finished elements
 }
 
+// Safe Asynchronous Indexed Priority Queue with int priorities, where smaller priorities run first
+type SAIPQueue = SAIPQueueOf[int]
+
 // Returns a new Safe Asynchronous Indexed Priority Queue
 // with f as the handler function for elements, and limit as the
 // maximum number of simultaneously executing elements
 func NewSAIPQueue(f QueueFunction, limit int) *SAIPQueue {
-	var Q SAIPQueue
+	return NewSAIPQueueOf(f, limit, cmp.Less[int])
+}
+
+// Returns a new Safe Asynchronous Indexed Priority Queue
+// with elements ordered by less, which reports whether priority a runs
+// before priority b. Elements with equal (==) priorities run in the order
+// they were added. Distinct priorities which are ordered equally (neither is
+// less) run in the order each was first waiting. This allows priorities such
+// as struct{ Tier, Deadline int }.
+func NewSAIPQueueOf[P comparable](f QueueFunction, limit int, less func(a, b P) bool) *SAIPQueueOf[P] {
+	var Q SAIPQueueOf[P]
 	Q.lock = new(sync.Mutex)
 	Q.execLock = new(sync.Mutex)
 	Q.waitCond = sync.NewCond(new(sync.Mutex))
-	Q.elements = MakeIndexedPriorityElements()
-	Q.execElements = make([]*PriorityElement, 0)
+	Q.elements = MakeIndexedPriorityElementsOf(less)
+	Q.execElements = make([]*PriorityElementOf[P], 0)
 	Q.limit = limit
-	Q.function = f
-	Q.stopped = false
+	Q.function = contextJobFunction(contextFunction(f))
+	Q.changed = make(chan struct{})
 	Q.errFunc = defaultErrFunc
 	return &Q
 }
 
-func (Q *SAIPQueue) exec(e *PriorityElement) {
+// Returns a new Safe Asynchronous Indexed Priority Queue
+// which runs the element with the earliest deadline first, with deadlines
+// as the priorities. Elements which miss their deadlines are recorded,
+// see DeadlineStats and SetDeadlineMissFunc.
+func NewSAIPQueueEDF(f QueueFunction, limit int) *SAIPQueueOf[time.Time] {
+	Q := NewSAIPQueueOf(f, limit, time.Time.Before)
+	Q.deadline = func(deadline time.Time) time.Time { return deadline }
+	return Q
+}
+
+func (Q *SAIPQueueOf[P]) exec(e *PriorityElementOf[P], ctx context.Context, f QueueJobFunction, itemFunc QueueItemFunction, missFunc QueueDeadlineMissFunction) {
+	started := time.Now()
+	// Execute the function and return it in a defer (in case it panics)
+	var r string
+	var results []string
+	var failure error
 	defer func() {
-		if r := recover(); r != nil {
-			Q.errFunc(e.Name, r)
+		finished := time.Now()
+		e.cancel()
+		if err := recover(); err != nil {
+			Q.errFunc(e.Name, err)
+			failure = ErrPanicked
 		}
-		// Remove the element
-		func() {
-			Q.execLock.Lock()
-			defer Q.execLock.Unlock()
-			for i, elem := range Q.execElements {
-				if elem == e {
-					Q.execElements = append(Q.execElements[:i], Q.execElements[i+1:]...)
-					break
-				}
-			}
-		}()
+		Q.complete(e, r, results, failure, started, finished, missFunc)
 		// Broadcast the now empty slot in execElements
 		Q.waitCond.L.Lock()
 		defer Q.waitCond.L.Unlock()
+		Q.updateState()
 		Q.waitCond.Broadcast()
 	}()
-	// Execute the function and return it in a defer (in case it panics)
-	var r string
-	defer func() { e.OutChannel.Return(r) }()
-	r = Q.function(e.Name, e.Data)
+	if itemFunc != nil {
+		results = itemFunc(e.Name, e.Data)
+		if results == nil {
+			// No results at all, rather than the result of the queue function
+			results = []string{}
+		}
+	} else {
+		r, results, failure = runJob(ctx, f, e.Name, e.Data, e.Metadata)
+	}
 }
 
-func (Q *SAIPQueue) execTopElement() bool {
-	e := Q.elements.Front
-	for e != nil {
-		found := func() bool {
-			found := false
-			for _, elem := range Q.execElements {
-				if elem.Name == e.Name && elem != e {
-					found = true
-					break
-				}
+// Execute a batch of elements with one call of f
+func (Q *SAIPQueueOf[P]) execBatch(batch []*PriorityElementOf[P], f QueueJobFunction, missFunc QueueDeadlineMissFunction) {
+	started := time.Now()
+	// Execute the function and return the results in a defer (in case it panics)
+	var results []string
+	jobs := make([]*Job, len(batch))
+	defer func() {
+		finished := time.Now()
+		var failure error
+		if err := recover(); err != nil {
+			for _, e := range batch {
+				Q.errFunc(e.Name, err)
 			}
-			return found
-		}()
-		if !found {
-			if e == Q.elements.Front {
-				Q.elements.Pop()
-			} else {
-				Q.elements.RemoveElement(e)
+			// As with a single element, a panicked batch fails each element
+			failure = ErrPanicked
+		}
+		for i, e := range batch {
+			e.cancel()
+			var r string
+			var items []string
+			err := failure
+			if err == nil && jobs[i].Results != nil {
+				items = jobs[i].Results
+			} else if i < len(results) {
+				r = results[i]
+			} else if err == nil {
+				err = ErrNoResult
+			}
+			Q.complete(e, r, items, err, started, finished, missFunc)
+		}
+		// Broadcast the now empty slot
+		Q.waitCond.L.Lock()
+		defer Q.waitCond.L.Unlock()
+		Q.execLock.Lock()
+		Q.execBatches--
+		Q.execLock.Unlock()
+		Q.updateState()
+		Q.waitCond.Broadcast()
+	}()
+	for i, e := range batch {
+		jobs[i] = &Job{Name: e.Name, Data: e.Data, Metadata: e.Metadata}
+	}
+	results = f(context.Background(), jobs)
+}
+
+// Return the result of an executed element, or fail it with err, and remove it
+// from the executing elements
+func (Q *SAIPQueueOf[P]) complete(e *PriorityElementOf[P], r string, results []string, err error, started, finished time.Time, missFunc QueueDeadlineMissFunction) {
+	Q.execLock.Lock()
+	e.finished = true
+	preempted := e.preempted
+	Q.execLock.Unlock()
+	var done []Completion
+	// A preempted element has already been requeued, so its result is discarded
+	if !preempted {
+		if err != nil {
+			done = e.failAll(err)
+		} else if results != nil {
+			done = e.returnItems(results)
+		} else {
+			done = e.returnAll(r)
+		}
+		// Record whether it met its deadline
+		if !e.deadline.IsZero() {
+			miss := DeadlineMiss{e.Name, e.deadline, started, finished}
+			Q.execLock.Lock()
+			missed := Q.deadlineStats.add(miss)
+			Q.execLock.Unlock()
+			if missed && missFunc != nil {
+				missFunc(miss)
 			}
-			Q.execElements = append(Q.execElements, e)
-			go Q.exec(e)
+		}
+	}
+	// Remove the element
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	execElements := &Q.execElements
+	if preempted {
+		execElements = &Q.preemptedElements
+	}
+	for i, elem := range *execElements {
+		if elem == e {
+			*execElements = append((*execElements)[:i], (*execElements)[i+1:]...)
+			break
+		}
+	}
+	if Q.report != nil && !preempted {
+		Q.report.Completed = append(Q.report.Completed, e.Name)
+	}
+	if !preempted {
+		for _, C := range Q.completions {
+			C.add(e.Name, done)
+		}
+	}
+}
+
+// Whether an element with the name is executing, including preempted elements which have not yet returned
+func (Q *SAIPQueueOf[P]) isExecuting(name string) bool {
+	for _, elem := range Q.execElements {
+		if elem.Name == name {
+			return true
+		}
+	}
+	for _, elem := range Q.preemptedElements {
+		if elem.Name == name {
 			return true
 		}
+	}
+	return false
+}
+
+// Start executing e, unless an element with the same name is already executing
+func (Q *SAIPQueueOf[P]) tryExec(e *PriorityElementOf[P]) bool {
+	if Q.isExecuting(e.Name) || Q.isLingering(e) {
+		return false
+	}
+	if e == Q.elements.Front {
+		Q.elements.Pop()
+	} else {
+		Q.elements.RemoveElement(e)
+	}
+	Q.execElements = append(Q.execElements, e)
+	if Q.deadline != nil {
+		e.deadline = Q.deadline(e.Priority)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	if Q.batchFunc != nil {
+		// Collect the element into the batch being dispatched
+		Q.batch = append(Q.batch, e)
+		return true
+	}
+	go Q.exec(e, ctx, Q.function, Q.itemFunc, Q.missFunc)
+	return true
+}
+
+// If preemption is enabled, and the first waiting element which could run should
+// preempt the lowest priority executing element, cancel that element and requeue
+// it. Its slot is freed once its handler returns, and until then no other element
+// is preempted. Returns whether an element was preempted.
+func (Q *SAIPQueueOf[P]) preemptElement() bool {
+	if Q.preempt == nil || len(Q.preemptedElements) > 0 {
+		return false
+	}
+	// Find the lowest priority executing element, preferring the most recently started
+	var victim *PriorityElementOf[P]
+	for _, elem := range Q.execElements {
+		if !elem.finished && (victim == nil || !Q.elements.less(elem.Priority, victim.Priority)) {
+			victim = elem
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	e := Q.elements.Front
+	for e != nil && (Q.isExecuting(e.Name) || Q.isLingering(e)) {
 		e = e.Next
 	}
+	if e == nil || !Q.preempt(e.Priority, victim.Priority) {
+		return false
+	}
+	victim.preempted = true
+	victim.cancel()
+	for i, elem := range Q.execElements {
+		if elem == victim {
+			Q.execElements = append(Q.execElements[:i], Q.execElements[i+1:]...)
+			break
+		}
+	}
+	Q.preemptedElements = append(Q.preemptedElements, victim)
+	Q.elements.requeue(victim)
+	return true
+}
+
+// Whether priority can use the reserved slots
+func (Q *SAIPQueueOf[P]) isReserved(priority P) bool {
+	return !Q.elements.less(Q.reservedFor, priority)
+}
+
+func (Q *SAIPQueueOf[P]) execTopElement() bool {
+	// Check if the unreserved slots are all in use
+	unreservedFull := false
+	if Q.reserved > 0 && Q.batchFunc == nil {
+		unreserved := 0
+		for _, elem := range Q.execElements {
+			if !Q.isReserved(elem.Priority) {
+				unreserved++
+			}
+		}
+		for _, elem := range Q.preemptedElements {
+			if !Q.isReserved(elem.Priority) {
+				unreserved++
+			}
+		}
+		// At least one slot is left for the other elements
+		unreservedFull = unreserved >= max(Q.limit-Q.reserved, 1)
+	}
+	// Elements which have waited too long go first, oldest first
+	if Q.maxWait > 0 {
+		now := time.Now()
+		for e := Q.elements.Oldest; e != nil && now.Sub(e.Added) >= Q.maxWait; e = e.Newer {
+			if unreservedFull && !Q.isReserved(e.Priority) {
+				continue
+			}
+			if Q.tryExec(e) {
+				return true
+			}
+		}
+	}
+	for e := Q.elements.Front; e != nil; e = e.Next {
+		// The elements are in priority order, so none of the rest can use the reserved slots
+		if unreservedFull && !Q.isReserved(e.Priority) {
+			break
+		}
+		if Q.tryExec(e) {
+			return true
+		}
+	}
 	return false
 }
 
 // Insert an element into the queue. If an element of that name already
-// exists, the data will be appended into a list. Smaller priorities run first.
+// exists, the data will be appended into a list. Smaller priorities run first,
+// or with a custom ordering, priorities that are less.
+// If the queue is at capacity the element is handled by its FullPolicy, and
+// if the element is rejected its SafeReturn holds an empty result. Likewise
+// if the data would exceed the memory budget. AddElementResult returns the
+// error, such as ErrFull or ErrOverBudget, instead.
 // If the queue is closed AddElement will panic.
-func (Q *SAIPQueue) AddElement(Name, Data string, Priority int) (sr SafeReturn) {
-	if Q.closed {
+func (Q *SAIPQueueOf[P]) AddElement(Name, Data string, Priority P) SafeReturn {
+	sr, err := Q.addElement(context.Background(), Name, Data, Priority, nil, false, contribution{})
+	if err == ErrClosed {
 		panic("Unable to add element. Queue is closed")
 	}
+	return sr
+}
+
+// Insert an element into the queue as with AddElement, merging Metadata into
+// the metadata of the element, which is given to a QueueJobFunction.
+// Values added later replace those of the same keys added earlier.
+func (Q *SAIPQueueOf[P]) AddElementWithMetadata(Name, Data string, Priority P, Metadata map[string]string) SafeReturn {
+	sr, err := Q.addElement(context.Background(), Name, Data, Priority, Metadata, false, contribution{})
+	if err == ErrClosed {
+		panic("Unable to add element. Queue is closed")
+	}
+	return sr
+}
+
+// Insert an element into the queue as with AddElement. If the queue is at
+// capacity or memory budget and blocks when full, AddElementContext waits until
+// there is space, or returns ctx.Err() once ctx is done. If the element is
+// rejected, it returns ErrFull or ErrOverBudget, and if the queue is closed,
+// ErrClosed. On error, the SafeReturn already holds an empty result.
+func (Q *SAIPQueueOf[P]) AddElementContext(ctx context.Context, Name, Data string, Priority P) (SafeReturn, error) {
+	return Q.addElement(ctx, Name, Data, Priority, nil, false, contribution{})
+}
+
+// Insert an element into the queue as with AddElement, without blocking or
+// panicking. If the queue has no space, TryAddElement returns ErrFull or
+// ErrOverBudget whatever the policy (unless evicting makes space). If the queue
+// is closed it returns ErrClosed, and if it is stopped, ErrStopped. On error,
+// the SafeReturn already holds an empty result.
+func (Q *SAIPQueueOf[P]) TryAddElement(Name, Data string, Priority P) (SafeReturn, error) {
+	return Q.addElement(context.Background(), Name, Data, Priority, nil, true, contribution{})
+}
+
+// Insert an element into the queue as with AddElementContext, merging Metadata
+// into the metadata of the element as AddElementWithMetadata does
+func (Q *SAIPQueueOf[P]) AddElementContextWithMetadata(ctx context.Context, Name, Data string, Priority P, Metadata map[string]string) (SafeReturn, error) {
+	return Q.addElement(ctx, Name, Data, Priority, Metadata, false, contribution{})
+}
+
+// Insert an element into the queue as with TryAddElement, merging Metadata
+// into the metadata of the element as AddElementWithMetadata does
+func (Q *SAIPQueueOf[P]) TryAddElementWithMetadata(Name, Data string, Priority P, Metadata map[string]string) (SafeReturn, error) {
+	return Q.addElement(context.Background(), Name, Data, Priority, Metadata, true, contribution{})
+}
+
+// Insert an element into the queue as with AddElementContext, returning a
+// Handle on the data added. The Handle receives the result of the data or an
+// error, such as ErrFull, ErrClosed or ErrEvicted, and can withdraw the data
+// while it is waiting.
+func (Q *SAIPQueueOf[P]) AddElementResult(ctx context.Context, Name, Data string, Priority P) Handle {
+	H := makeHandle()
+	Q.addElement(ctx, Name, Data, Priority, nil, false, contribution{handle: H.result})
+	return H
+}
+
+// Insert an element, with c as the contribution of the data, which with try
+// fails rather than waiting for space, or being added to a stopped queue
+func (Q *SAIPQueueOf[P]) addElement(ctx context.Context, Name, Data string, Priority P, Metadata map[string]string, try bool, c contribution) (SafeReturn, error) {
 	Q.waitCond.L.Lock()
 	defer Q.waitCond.L.Unlock()
+	if !try && Q.checkBlocked(Name, len(Data)) {
+		// Wake up to check ctx once it is done
+		stop := context.AfterFunc(ctx, func() {
+			Q.waitCond.L.Lock()
+			defer Q.waitCond.L.Unlock()
+			Q.waitCond.Broadcast()
+		})
+		defer stop()
+		for Q.checkBlocked(Name, len(Data)) {
+			if err := ctx.Err(); err != nil {
+				c.resolve("", err)
+				return emptyReturn(), err
+			}
+			Q.waitCond.Wait()
+		}
+	}
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
+	if Q.closed {
+		c.resolve("", ErrClosed)
+		return emptyReturn(), ErrClosed
+	}
+	if try && (Q.state == StateStopping || Q.state == StateStopped) {
+		c.resolve("", ErrStopped)
+		return emptyReturn(), ErrStopped
+	}
+	sr, err := Q.insert(ctx, Name, Data, Priority, Metadata, c)
+	if err != nil {
+		c.resolve("", err)
+		return emptyReturn(), err
+	}
+	// Broadcast that the queue might be non-empty
+	Q.waitCond.Broadcast()
+	return sr, nil
+}
+
+// Insert an element with c as the contribution of its data, if there is space
+// for it, evicting another to make space if the policy allows. Requires Q.lock
+func (Q *SAIPQueueOf[P]) insert(ctx context.Context, Name, Data string, Priority P, Metadata map[string]string, c contribution) (SafeReturn, error) {
+	// Make space for the element
+	err := Q.hasSpace(Name, len(Data))
+	if err == ErrFull && Q.fullPolicy == EvictWhenFull {
+		// Evict the element which would run last
+		last := Q.elements.last()
+		if !Q.elements.less(Priority, last.Priority) {
+			// Which is the new element
+			return nil, ErrFull
+		}
+		for _, e := range Q.elements.drop(last) {
+			e.failAll(ErrEvicted)
+		}
+		err = Q.hasSpace(Name, len(Data))
+	}
+	if err != nil {
+		return nil, err
+	}
 	// Add the element
-	sr = Q.elements.AddElement(Name, Data, Priority)
+	if c.handle != nil {
+		c.handle.owner = Q
+		c.handle.name = Name
+	}
+	if Q.dropAbandoned && ctx.Done() != nil {
+		// The caller waits on the element until ctx is done
+		w := &watchers{waiters: 1}
+		w.watch = func(ctx context.Context) { Q.watch(Name, w, ctx) }
+		w.stops = append(w.stops, context.AfterFunc(ctx, func() { Q.release(Name, w) }))
+		c.waiters = w
+		if c.handle != nil {
+			c.handle.watchers = w
+		}
+	}
+	if (Q.itemFunc != nil || Q.jobs) && c.handle == nil {
+		// The caller receives the result of its own data
+		c.out = make(SafeReturn, 1)
+	}
+	if c.handle == nil && c.waiters == nil && c.out == nil {
+		// The caller shares the result of the element
+		return Q.elements.insert(Name, Data, Priority, Metadata, nil), nil
+	}
+	return Q.elements.insert(Name, Data, Priority, Metadata, &c), nil
+}
+
+// Insert a batch of elements into the queue as with AddElement, taking the
+// lock and waking the queue once for the whole batch. Rather than block when
+// the queue is full, an element which does not fit is rejected, and its
+// SafeReturn holds an empty result. Returns the SafeReturn of each element, in
+// the same order.
+// If the queue is closed AddElements will panic.
+func (Q *SAIPQueueOf[P]) AddElements(items []PriorityItemOf[P]) []SafeReturn {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.closed {
+		panic("Unable to add elements. Queue is closed")
+	}
+	srs := make([]SafeReturn, len(items))
+	for i, item := range items {
+		sr, err := Q.insert(context.Background(), item.Name, item.Data, item.Priority, item.Metadata, contribution{})
+		if err != nil {
+			sr = emptyReturn()
+		}
+		srs[i] = sr
+	}
 	// Broadcast that the queue might be non-empty
 	Q.waitCond.Broadcast()
-	return
+	return srs
+}
+
+// Withdraw the data added with r from the waiting element of the name, and
+// wake the queue to the space freed
+func (Q *SAIPQueueOf[P]) withdraw(Name string, r *result) bool {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	withdrawn := Q.elements.withdraw(Name, r)
+	Q.lock.Unlock()
+	if withdrawn {
+		Q.updateState()
+		Q.waitCond.Broadcast()
+	}
+	return withdrawn
+}
+
+// Count a waiter on data with the waiters w until ctx is done, if the data
+// is still waiting
+func (Q *SAIPQueueOf[P]) watch(Name string, w *watchers, ctx context.Context) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if !Q.elements.holds(Name, w) {
+		return
+	}
+	w.waiters++
+	w.stops = append(w.stops, context.AfterFunc(ctx, func() { Q.release(Name, w) }))
+}
+
+// Count a waiter in w as gone, and remove its element if no waiters are left
+func (Q *SAIPQueueOf[P]) release(Name string, w *watchers) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	w.waiters--
+	dropped := w.waiters == 0 && Q.elements.dropAbandoned(Name)
+	Q.lock.Unlock()
+	if dropped {
+		Q.updateState()
+		Q.waitCond.Broadcast()
+	}
 }
 
 // Update the limit on the number of simultaneously executing
 // elements. If there are more than limit currently executing,
 // the queue will wait until it is under the new limit.
-func (Q *SAIPQueue) SetLimit(limit int) {
+func (Q *SAIPQueueOf[P]) SetLimit(limit int) {
 	Q.waitCond.L.Lock()
 	defer Q.waitCond.L.Unlock()
 	Q.limit = limit
 	Q.waitCond.Broadcast()
 }
 
+// Reserve slots of the limit for elements with priorities at or before
+// threshold (priority <= threshold). Other elements can only occupy the
+// remaining limit-slots executing slots. At most limit-1 slots are reserved,
+// so that other elements can always run. Zero slots removes the reservation.
+func (Q *SAIPQueueOf[P]) SetReserved(slots int, threshold P) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.reserved = slots
+	Q.reservedFor = threshold
+	Q.waitCond.Broadcast()
+}
+
+// Set the handler function for elements to one which is given a context.
+// The context is canceled if the element is preempted.
+func (Q *SAIPQueueOf[P]) SetContextFunction(f QueueContextFunction) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.function = contextJobFunction(f)
+}
+
+// Set a handler function which returns the result of each data item of an
+// element, in place of the queue function. The SafeReturn (or Handle) of each
+// add call then resolves with the result of its own data item, rather than one
+// result shared by the element. A nil f uses the queue function again.
+func (Q *SAIPQueueOf[P]) SetItemFunction(f QueueItemFunction) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.itemFunc = f
+}
+
+// Enable preemption. When the limit is reached and preempt reports that the
+// first waiting element should preempt the lowest priority executing element,
+// the executing element's context is canceled, and it is requeued with its
+// data intact. Its slot is freed once its handler returns, so the handler should
+// return promptly once its context is canceled, and its result is discarded.
+// One element is preempted at a time. A nil preempt disables preemption.
+// For example, with int priorities, to preempt elements at least 2 priorities
+// lower: func(waiting, running int) bool { return running-waiting >= 2 }
+func (Q *SAIPQueueOf[P]) SetPreemption(preempt func(waiting, running P) bool) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.preempt = preempt
+	Q.waitCond.Broadcast()
+}
+
+// Set the aging policy to prevent starvation of large priorities. Elements
+// which have been waiting for at least maxWait are promoted ahead of all
+// other elements, and run in the order they were added. Zero disables aging.
+func (Q *SAIPQueueOf[P]) SetAging(maxWait time.Duration) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.maxWait = maxWait
+}
+
+// Track deadlines of elements, as given by deadline for each priority.
+// Elements with a zero deadline are not tracked. Queues made with
+// NewSAIPQueueEDF already track their priorities as deadlines.
+func (Q *SAIPQueueOf[P]) SetDeadlineFunc(deadline func(p P) time.Time) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.deadline = deadline
+}
+
+// Set a function to be called with each element which finishes
+// after its deadline, in addition to it being counted in DeadlineStats.
+func (Q *SAIPQueueOf[P]) SetDeadlineMissFunc(missFunc QueueDeadlineMissFunction) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.missFunc = missFunc
+}
+
+// Returns the deadline statistics of the elements which have finished
+func (Q *SAIPQueueOf[P]) DeadlineStats() DeadlineStats {
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	return Q.deadlineStats
+}
+
+// Set the maximum number of elements waiting in the queue, and what to do
+// when adding an element to a full queue. Adding data to an element which is
+// already waiting always succeeds. Zero capacity removes the maximum.
+func (Q *SAIPQueueOf[P]) SetCapacity(capacity int, policy FullPolicy) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.capacity = capacity
+	Q.fullPolicy = policy
+	Q.waitCond.Broadcast()
+}
+
+// Set the maximum total size in bytes of the data waiting in the queue, and
+// of the data of each waiting element, and what to do when adding data which
+// would exceed either. Each follow-on chunk of an element is charged
+// separately. Data which could never fit is always rejected, and
+// EvictWhenFull rejects as RejectWhenFull does. Zero removes a maximum.
+func (Q *SAIPQueueOf[P]) SetMemoryBudget(queueBytes, elementBytes int, policy FullPolicy) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.byteBudget = queueBytes
+	Q.elementBudget = elementBytes
+	Q.budgetPolicy = policy
+	Q.waitCond.Broadcast()
+}
+
+// Execute elements in batches of up to size with f, in place of the queue
+// function. Each batch takes the elements in the order they would otherwise
+// run, none of them with the same name, and the limit is instead on the
+// number of batches executing at once. Reserved slots and preemption do not
+// apply to batches. A nil f executes elements one at a time again.
+func (Q *SAIPQueueOf[P]) SetBatchFunction(f QueueBatchFunction, size int) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.batchFunc = batchJobFunction(f)
+	Q.batchSize = max(size, 1)
+	Q.waitCond.Broadcast()
+}
+
+// Set the handler function for elements to f, which is given each element
+// with its metadata. With size above 1, f executes batches of up to size
+// elements as SetBatchFunction does, and otherwise one element at a time
+// with a context, as SetContextFunction does. A job whose Results f sets
+// returns the result of each of its data items, as SetItemFunction does.
+func (Q *SAIPQueueOf[P]) SetJobFunction(f QueueJobFunction, size int) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.jobs = true
+	if size > 1 {
+		Q.batchFunc = f
+		Q.batchSize = size
+	} else {
+		Q.function = f
+		Q.batchFunc = nil
+	}
+	Q.waitCond.Broadcast()
+}
+
+// Set how long elements wait to collect more data before they can execute
+func (Q *SAIPQueueOf[P]) SetLinger(l Linger) {
+	Q.SetLingerFunc(func(name string) Linger { return l })
+}
+
+// Set how long each element waits to collect more data before it can
+// execute, by name. A nil f executes elements without waiting.
+func (Q *SAIPQueueOf[P]) SetLingerFunc(f func(name string) Linger) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.linger = f
+	Q.waitCond.Broadcast()
+}
+
+// Set the maximum number of data items in each element. Further data for
+// the name of a full element goes into a follow-on element, which takes its
+// place in the queue once it starts executing, and so executes after it.
+// Follow-on elements do not count toward the capacity. Zero removes the
+// maximum.
+func (Q *SAIPQueueOf[P]) SetMaxDataPerElement(n int) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.elements.maxData = n
+	Q.waitCond.Broadcast()
+}
+
+// Set whether to remove waiting elements once all of their waiters have
+// gone. Each element added with AddElementContext or AddElementResult then
+// waits on its ctx, and each call to ResultContext on its Handle adds a
+// waiter until its ctx is done. Elements added with AddElement or TryAddElement are always waited on.
+// Once the last waiter of an element has gone, it is removed from the queue
+// and fails with ErrAbandoned. This applies to elements added after it is set.
+func (Q *SAIPQueueOf[P]) SetDropAbandoned(drop bool) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.dropAbandoned = drop
+}
+
 // Set a new error handling function, which handles panics encountered
 // When executing elements. By default this is a log.Println
-func (Q *SAIPQueue) SetErrorFunc(errFunc QueueErrFunction) {
+// The panicked elements then fail with ErrPanicked.
+func (Q *SAIPQueueOf[P]) SetErrorFunc(errFunc QueueErrFunction) {
 	Q.errFunc = errFunc
 }
 
+// Returns the lifecycle state of the queue
+func (Q *SAIPQueueOf[P]) State() State {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.state
+}
+
+// Returns the lifecycle state of the queue, and a channel which
+// is closed when the state next changes
+func (Q *SAIPQueueOf[P]) WatchState() (State, <-chan struct{}) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.state, Q.changed
+}
+
 // Stops the execution of the queue. Currently executing elements
 // will continue to run, but no enqueued elements will start executing.
-// You must re-run Run to start the queue again.
-func (Q *SAIPQueue) Stop() {
-	Q.stopped = true
+// You must re-run Run to start the queue again. Enqueued elements wait for
+// it, unless StopAndDump is used to remove them and release their waiters.
+func (Q *SAIPQueueOf[P]) Stop() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	if Q.state != StateStopped && Q.state != StateClosed {
+		Q.setState(StateStopping)
+	}
+	Q.lock.Unlock()
+	Q.updateState()
+}
+
+// Stops the queue as Stop does, and removes all enqueued elements as
+// DumpElements does, failing them with ErrDropped to release their waiters
+func (Q *SAIPQueueOf[P]) StopAndDump() []*PriorityElementOf[P] {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	Q.lock.Lock()
+	if Q.state != StateStopped && Q.state != StateClosed {
+		Q.setState(StateStopping)
+	}
+	r := Q.elements.DumpElements()
+	Q.lock.Unlock()
+	Q.updateState()
+	return r
+}
+
+// Pauses the running queue. Elements can still be added, and currently
+// executing elements will continue to run, but no enqueued elements will
+// start executing until Resume is called.
+func (Q *SAIPQueueOf[P]) Pause() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.state == StateRunning {
+		Q.setState(StatePaused)
+	}
+}
+
+// Resumes executing elements in a paused queue
+func (Q *SAIPQueueOf[P]) Resume() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.state == StatePaused {
+		Q.setState(StateRunning)
+	}
 }
 
 // Closes the queue to prevent more elements from being enqueued.
-// If an new element is attempted to be added, AddElement will panic.
+// If an new element is attempted to be added, AddElement will panic,
+// and AddElementContext and TryAddElement return ErrClosed.
 // There is no way to re-open a queue once closed.
-func (Q *SAIPQueue) Close() {
+func (Q *SAIPQueueOf[P]) Close() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
 	Q.closed = true
+	Q.lock.Unlock()
+	Q.updateState()
+	Q.waitCond.Broadcast()
 }
 
 // Waits for the queue to finish stopping/closing. Use after calling Stop or Close.
-// If only stopped, Wait will wait until all executing elements have completed.
-// If closed, Wait will wait until the queue is empty.
-func (Q *SAIPQueue) Wait() {
-	if Q.stopped {
+// If stopped, Wait will wait until all executing elements have completed.
+// If only closed, Wait will wait until the queue is empty, or is stopped.
+func (Q *SAIPQueueOf[P]) Wait() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	for Q.state == StateStopping || (Q.closed && Q.state != StateStopped && Q.state != StateClosed) {
+		Q.waitCond.Wait()
+	}
+}
+
+// Closes the queue and waits for Run to execute the remaining elements.
+// Once ctx is done (or the queue is stopped), the elements still waiting are
+// removed and fail with ErrShutdown. Elements executing at that point are
+// not waited for. Returns the names of the elements which were completed
+// during the shutdown, canceled, and still running.
+func (Q *SAIPQueueOf[P]) Shutdown(ctx context.Context) ShutdownReport {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	report := new(ShutdownReport)
+	func() {
+		Q.lock.Lock()
+		defer Q.lock.Unlock()
+		Q.execLock.Lock()
+		defer Q.execLock.Unlock()
+		Q.closed = true
+		Q.report = report
+	}()
+	Q.waitCond.Broadcast()
+	// Wake up to check ctx once it is done
+	stop := context.AfterFunc(ctx, func() {
 		Q.waitCond.L.Lock()
+		defer Q.waitCond.L.Unlock()
+		Q.waitCond.Broadcast()
+	})
+	defer stop()
+	for Q.state != StateStopping && Q.state != StateStopped && ctx.Err() == nil && !Q.checkEmpty() {
+		Q.waitCond.Wait()
+	}
+	Q.lock.Lock()
+	Q.execLock.Lock()
+	for _, e := range Q.elements.dump() {
+		report.Canceled = append(report.Canceled, e.Name)
+		e.failAll(ErrShutdown)
+	}
+	for _, e := range Q.execElements {
+		report.Running = append(report.Running, e.Name)
+	}
+	Q.report = nil
+	Q.execLock.Unlock()
+	Q.lock.Unlock()
+	Q.updateState()
+	return *report
+}
+
+// Returns the number of elements waiting in the queue, and
+// the number of currently executing elements
+func (Q *SAIPQueueOf[P]) NumElements() (int, int) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	return len(Q.elements.NameIndex), len(Q.execElements)
+}
+
+// Returns the total size in bytes of the data waiting in the queue,
+// and of the data of currently executing elements
+func (Q *SAIPQueueOf[P]) NumBytes() (int, int) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	executing := 0
+	for _, e := range Q.execElements {
+		executing += e.size
+	}
+	return Q.elements.Bytes(), executing
+}
+
+// Returns an iterator over copies of the elements waiting in the queue, in
+// the order they would be dispatched now as with Snapshot, except that each
+// is followed directly by its follow-on chunks. The queue is locked for each
+// element rather than for the whole iteration, so changes to the queue while
+// iterating may not be seen.
+func (Q *SAIPQueueOf[P]) All() iter.Seq[*PriorityElementOf[P]] {
+	return func(yield func(*PriorityElementOf[P]) bool) {
+		seen := make(map[*PriorityElementOf[P]]bool)
+		now := time.Now()
+		aged := true
+		var e *PriorityElementOf[P]
 		for {
-			if Q.checkExecEmpty() {
-				break
+			var elements []*PriorityElementOf[P]
+			if aged {
+				// Elements which have waited too long go first, oldest first
+				if e, elements = Q.nextAged(e, seen, now); e == nil {
+					aged = false
+					continue
+				}
+			} else if e, elements = Q.nextWaiting(e, seen); e == nil {
+				return
+			}
+			for _, c := range elements {
+				if !yield(c) {
+					return
+				}
 			}
-			Q.waitCond.Wait()
 		}
-		Q.waitCond.L.Unlock()
 	}
-	if Q.closed {
-		Q.waitCond.L.Lock()
+}
+
+// Finds the first waiting element after prev (or from the front, if prev is
+// no longer waiting) which has not been seen, and returns it along with
+// copies of it and its follow-on chunks
+func (Q *SAIPQueueOf[P]) nextWaiting(prev *PriorityElementOf[P], seen map[*PriorityElementOf[P]]bool) (*PriorityElementOf[P], []*PriorityElementOf[P]) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	e := Q.elements.Front
+	if prev != nil && Q.elements.NameIndex[prev.Name] == prev {
+		e = prev.Next
+	}
+	for e != nil && seen[e] {
+		e = e.Next
+	}
+	if e == nil {
+		return nil, nil
+	}
+	return e, see(e, seen)
+}
+
+// Finds the first waiting element after prev in the age order (or from the
+// oldest, if prev is no longer waiting) which has not been seen, if it has
+// waited for at least the maximum wait as of now, and returns it along with
+// copies of it and its follow-on chunks
+func (Q *SAIPQueueOf[P]) nextAged(prev *PriorityElementOf[P], seen map[*PriorityElementOf[P]]bool, now time.Time) (*PriorityElementOf[P], []*PriorityElementOf[P]) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.maxWait <= 0 {
+		return nil, nil
+	}
+	e := Q.elements.Oldest
+	if prev != nil && Q.elements.NameIndex[prev.Name] == prev {
+		e = prev.Newer
+	}
+	for e != nil && seen[e] {
+		e = e.Newer
+	}
+	if e == nil || now.Sub(e.Added) < Q.maxWait {
+		return nil, nil
+	}
+	return e, see(e, seen)
+}
+
+// Returns an iterator over the names and results of elements as they finish,
+// from when iteration starts until ctx is done or the queue is closed. An
+// element run with an item function yields the result of each add call.
+func (Q *SAIPQueueOf[P]) Completed(ctx context.Context) iter.Seq2[string, Completion] {
+	return func(yield func(string, Completion) bool) {
+		C := newCompletions()
+		Q.execLock.Lock()
+		Q.completions = append(Q.completions, C)
+		Q.execLock.Unlock()
+		defer func() {
+			Q.execLock.Lock()
+			defer Q.execLock.Unlock()
+			for i, c := range Q.completions {
+				if c == C {
+					Q.completions = append(Q.completions[:i], Q.completions[i+1:]...)
+					break
+				}
+			}
+		}()
 		for {
-			if Q.checkEmpty() {
-				break
+			// Elements have all finished by the time the queue is closed
+			state, changed := Q.WatchState()
+			names, results := C.take()
+			for i := range names {
+				if !yield(names[i], results[i]) {
+					return
+				}
+			}
+			if state == StateClosed {
+				return
+			}
+			select {
+			case <-C.ready:
+			case <-changed:
+			case <-ctx.Done():
+				return
 			}
-			Q.waitCond.Wait()
 		}
-		Q.waitCond.L.Unlock()
 	}
 }
 
-// Returns the number of elements waiting in the queue, and
-// the number of currently executing elements
-func (Q *SAIPQueue) NumElements() (int, int) {
+// Move the waiting element of the name to the front of its priority, to run
+// before the other elements of that priority. Returns false if there is none.
+func (Q *SAIPQueueOf[P]) MoveToFront(name string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.MoveToFront(name)
+}
+
+// Move the waiting element of the name to the back of its priority, to run
+// after the other elements of that priority. Returns false if there is none.
+func (Q *SAIPQueueOf[P]) MoveToBack(name string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.MoveToBack(name)
+}
+
+// Move the waiting element of the name to just before the waiting element of
+// other, taking on its priority. Returns false if either is not waiting, or
+// they are the same.
+func (Q *SAIPQueueOf[P]) MoveBefore(name, other string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.MoveBefore(name, other)
+}
+
+// Returns the number of waiting elements whose names match, such as
+// with MatchPrefix
+func (Q *SAIPQueueOf[P]) CountMatching(match func(name string) bool) int {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return len(Q.elements.matching(match))
+}
+
+// Removes the waiting elements whose names match, as one operation, and
+// fails them with ErrCanceled. Returns how many there were.
+func (Q *SAIPQueueOf[P]) CancelMatching(match func(name string) bool) int {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	matched := Q.elements.matching(match)
+	for _, e := range matched {
+		for _, d := range Q.elements.drop(e) {
+			d.failAll(ErrCanceled)
+		}
+	}
+	Q.lock.Unlock()
+	Q.updateState()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	return len(matched)
+}
+
+// Sets the priority of the waiting elements whose names match, as one
+// operation, and returns how many there were. They go to the back of the
+// priority, in the order they were in.
+func (Q *SAIPQueueOf[P]) SetPriorityMatching(match func(name string) bool, priority P) int {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	matched := Q.elements.matching(match)
+	for _, e := range matched {
+		Q.elements.setPriority(e, priority)
+	}
+	Q.waitCond.Broadcast()
+	return len(matched)
+}
+
+// Returns copies of the elements waiting in the queue, and of the currently
+// executing elements. The waiting elements are in the order they would be
+// dispatched now, with aged elements first, though reserved slots and names
+// which are still executing may hold some of them back.
+func (Q *SAIPQueueOf[P]) Snapshot() ([]*PriorityElementOf[P], []*PriorityElementOf[P]) {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
 	Q.execLock.Lock()
 	defer Q.execLock.Unlock()
-	return len(Q.elements.NameIndex), len(Q.execElements)
+	executing := make([]*PriorityElementOf[P], len(Q.execElements))
+	for i, e := range Q.execElements {
+		executing[i] = e.copy()
+	}
+	return Q.elements.snapshot(Q.maxWait), executing
 }
 
-// Removes all elements from the queue and returns them as a slice
-func (Q *SAIPQueue) DumpElements() []*PriorityElement {
+// Removes all elements from the queue in the order they would execute,
+// and returns them as a slice, failing them with ErrDropped so that anything
+// waiting on them is released
+func (Q *SAIPQueueOf[P]) Drain() []*PriorityElementOf[P] {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	defer Q.updateState()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.Drain()
+}
+
+// Removes all elements from the queue and returns them as a slice, failing
+// them with ErrDropped so that anything waiting on them is released
+func (Q *SAIPQueueOf[P]) DumpElements() []*PriorityElementOf[P] {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	defer Q.updateState()
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
 	return Q.elements.DumpElements()
 }
 
-func (Q *SAIPQueue) checkEmpty() bool {
+// Whether there is space to add size bytes of data to the element of the name.
+// Returns ErrFull if there is no space for a new element, or ErrOverBudget
+// if the data would exceed the memory budget.
+func (Q *SAIPQueueOf[P]) hasSpace(Name string, size int) error {
+	_, ok := Q.elements.NameIndex[Name]
+	if !ok && Q.capacity > 0 && len(Q.elements.NameIndex) >= Q.capacity {
+		return ErrFull
+	}
+	if Q.byteBudget > 0 && Q.elements.Bytes()+size > Q.byteBudget {
+		return ErrOverBudget
+	}
+	if Q.elementBudget > 0 {
+		if e := Q.elements.receiver(Name); e != nil {
+			size += e.size
+		}
+		if size > Q.elementBudget {
+			return ErrOverBudget
+		}
+	}
+	return nil
+}
+
+// Whether adding size bytes of data to the element of the name must wait for space
+func (Q *SAIPQueueOf[P]) checkBlocked(Name string, size int) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.closed {
+		return false
+	}
+	switch Q.hasSpace(Name, size) {
+	case ErrFull:
+		return Q.fullPolicy == BlockWhenFull
+	case ErrOverBudget:
+		// Only wait if the data fits into an empty queue
+		fits := (Q.byteBudget <= 0 || size <= Q.byteBudget) && (Q.elementBudget <= 0 || size <= Q.elementBudget)
+		return Q.budgetPolicy == BlockWhenFull && fits
+	}
+	return false
+}
+
+// Set the state, and signal the change. Requires Q.waitCond.L and Q.lock
+func (Q *SAIPQueueOf[P]) setState(state State) {
+	if Q.state == state {
+		return
+	}
+	Q.state = state
+	close(Q.changed)
+	Q.changed = make(chan struct{})
+	Q.waitCond.Broadcast()
+}
+
+// Move on to Stopped or Closed once the queue is done with its elements.
+// Requires Q.waitCond.L
+func (Q *SAIPQueueOf[P]) updateState() {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.execLock.Lock()
+	executing := len(Q.execElements) > 0 || len(Q.preemptedElements) > 0
+	Q.execLock.Unlock()
+	if Q.closed && len(Q.elements.NameIndex) == 0 && !executing {
+		Q.setState(StateClosed)
+	} else if Q.state == StateStopping && !executing && !Q.looping {
+		Q.setState(StateStopped)
+	}
+}
+
+// Start a Run loop, unless one is already active or the queue is closed.
+// Requires Q.waitCond.L
+func (Q *SAIPQueueOf[P]) startRun() bool {
+	// Let a stopping loop exit first
+	for Q.looping && Q.state != StateRunning && Q.state != StatePaused {
+		Q.waitCond.Wait()
+	}
+	if Q.looping || Q.state == StateClosed {
+		return false
+	}
+	Q.looping = true
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.setState(StateRunning)
+	return true
+}
+
+// End a Run loop. Requires Q.waitCond.L
+func (Q *SAIPQueueOf[P]) endRun() {
+	Q.looping = false
+	// Nothing waits for lingering elements until the queue runs again
+	Q.lock.Lock()
+	if Q.lingerTimer != nil {
+		Q.lingerTimer.Stop()
+	}
+	Q.lock.Unlock()
+	Q.updateState()
+	Q.waitCond.Broadcast()
+}
+
+// Whether e is still waiting for more data. Keeps track of when the first
+// lingering element can execute in Q.lingerUntil. Requires Q.lock
+func (Q *SAIPQueueOf[P]) isLingering(e *PriorityElementOf[P]) bool {
+	if Q.linger == nil {
+		return false
+	}
+	l := Q.linger(e.Name)
+	if l.MaxData > 0 && len(e.Data) >= l.MaxData {
+		return false
+	}
+	until := e.updated.Add(l.Quiet)
+	if l.MaxWait > 0 && e.Added.Add(l.MaxWait).Before(until) {
+		until = e.Added.Add(l.MaxWait)
+	}
+	if !time.Now().Before(until) {
+		return false
+	}
+	if Q.lingerUntil.IsZero() || until.Before(Q.lingerUntil) {
+		Q.lingerUntil = until
+	}
+	return true
+}
+
+// Wake the queue once the first lingering element can execute. Requires Q.lock
+func (Q *SAIPQueueOf[P]) wakeForLinger() {
+	if Q.lingerUntil.IsZero() {
+		return
+	}
+	d := time.Until(Q.lingerUntil)
+	if Q.lingerTimer == nil {
+		Q.lingerTimer = time.AfterFunc(d, func() {
+			Q.waitCond.L.Lock()
+			defer Q.waitCond.L.Unlock()
+			Q.waitCond.Broadcast()
+		})
+	} else {
+		Q.lingerTimer.Reset(d)
+	}
+}
+
+func (Q *SAIPQueueOf[P]) checkEmpty() bool {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
 	Q.execLock.Lock()
 	defer Q.execLock.Unlock()
-	return len(Q.elements.NameIndex) == 0 && len(Q.execElements) == 0
+	return len(Q.elements.NameIndex) == 0 && len(Q.execElements) == 0 && len(Q.preemptedElements) == 0
 }
 
-func (Q *SAIPQueue) checkExecEmpty() bool {
+func (Q *SAIPQueueOf[P]) checkExecEmpty() bool {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
 	Q.execLock.Lock()
 	defer Q.execLock.Unlock()
-	return len(Q.execElements) == 0
+	return len(Q.execElements) == 0 && len(Q.preemptedElements) == 0
 }
 
-func (Q *SAIPQueue) checkExec() bool {
+func (Q *SAIPQueueOf[P]) checkExec() bool {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
+	Q.lingerUntil = time.Time{}
+	defer Q.wakeForLinger()
 	if Q.elements.Front == nil {
 		return false
 	}
 	Q.execLock.Lock()
 	defer Q.execLock.Unlock()
-	if len(Q.execElements) >= Q.limit {
-		return false
+	if Q.batchFunc != nil {
+		if Q.execBatches >= Q.limit {
+			return false
+		}
+		for len(Q.batch) < Q.batchSize && Q.execTopElement() {
+		}
+		if len(Q.batch) == 0 {
+			return false
+		}
+		Q.execBatches++
+		go Q.execBatch(Q.batch, Q.batchFunc, Q.missFunc)
+		Q.batch = nil
+	} else {
+		// Preempted elements hold their slots until their handlers return
+		if len(Q.execElements)+len(Q.preemptedElements) >= Q.limit {
+			Q.preemptElement()
+			return false
+		}
+		if !Q.execTopElement() {
+			return false
+		}
 	}
-	return Q.execTopElement()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	return true
 }
 
 // Run the queue, executing elements repeatedly
-// Will loop forever (until stopped), so spawn this in a new thread
-func (Q *SAIPQueue) Run() {
-	Q.stopped = false
-	for !Q.stopped {
+// Will loop until stopped or closed, so spawn this in a new thread. If the
+// queue is already running, Run returns immediately
+func (Q *SAIPQueueOf[P]) Run() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	if !Q.startRun() {
+		return
+	}
+	defer Q.endRun()
+	for Q.state == StateRunning || Q.state == StatePaused {
 		// Wait for non-empty queue and wait for an open space
 		// and wait for an element with a name that doesn't match
-		// any currently executing elements
-		Q.waitCond.L.Lock()
-		for !Q.stopped {
-			if Q.checkExec() {
-				break
-			}
+		// any currently executing elements, and while paused
+		if Q.state == StatePaused || !Q.checkExec() {
 			Q.waitCond.Wait()
 		}
-		Q.waitCond.L.Unlock()
 	}
 }
@@ -18,21 +18,42 @@
 package sapip
 
 import (
+	"context"
+	"iter"
 	"sync"
 	"time"
 )
 
 type SAPIQueue struct {
-	lock         *sync.Mutex // Global lock
-	execLock     *sync.Mutex // Lock for manipulating execElements
-	waitCond     *sync.Cond  // Wait for queue to be non-empty and have an open slow in execElements
-	elements     IndexedElements
-	execElements []*Element
-	limit        int
-	function     QueueFunction
-	closed       bool
-	stopped      bool
-	errFunc      QueueErrFunction
+	lock          *sync.Mutex // Global lock
+	execLock      *sync.Mutex // Lock for manipulating execElements
+	waitCond      *sync.Cond  // Wait for queue to be non-empty and have an open slow in execElements
+	elements      IndexedElements
+	execElements  []*Element
+	limit         int
+	function      QueueJobFunction
+	itemFunc      QueueItemFunction // Returns the result of each data item, if set
+	batchFunc     QueueJobFunction  // Executes elements in batches, if set
+	jobs          bool              // Whether a job function has been set, so each add call has its own result
+	batchSize     int
+	batch         []*Element // Batch being collected for dispatch
+	execBatches   int        // Number of executing batches
+	closed        bool
+	state         State
+	changed       chan struct{} // Closed and replaced on each change of state
+	looping       bool          // Whether a Run loop is active
+	errFunc       QueueErrFunction
+	capacity      int // Maximum number of waiting elements, or 0 for no maximum
+	fullPolicy    FullPolicy
+	byteBudget    int // Maximum total size in bytes of waiting data, or 0 for no maximum
+	elementBudget int // Maximum size in bytes of the data of each waiting element, or 0 for no maximum
+	budgetPolicy  FullPolicy
+	linger        func(name string) Linger // How long each element waits for more data, if set
+	lingerUntil   time.Time                // When the first lingering element can execute
+	lingerTimer   *time.Timer              // Wakes the queue once lingering elements can execute
+	report        *ShutdownReport          // Report of the shutdown in progress, if any
+	dropAbandoned bool                     // Whether elements are removed once all of their waiters have gone
+	completions   []*completions           // Collect results for iterators over finished elements
 }
 
 // Returns a new Safe Asynchronous Indexed Periodic Queue
@@ -46,37 +67,107 @@ func NewSAPIQueue(f QueueFunction, limit int) *SAPIQueue {
 	Q.elements = MakeIndexedElements()
 	Q.execElements = make([]*Element, 0)
 	Q.limit = limit
-	Q.function = f
-	Q.stopped = false
+	Q.function = contextJobFunction(contextFunction(f))
+	Q.changed = make(chan struct{})
 	Q.errFunc = defaultErrFunc
 	return &Q
 }
 
-func (Q *SAPIQueue) exec(e *Element) {
+func (Q *SAPIQueue) exec(e *Element, f QueueJobFunction, itemFunc QueueItemFunction) {
+	// Execute the function and return it in a defer (in case it panics)
+	var r string
+	var results []string
+	var failure error
 	defer func() {
-		if r := recover(); r != nil {
-			Q.errFunc(e.Name, r)
+		if err := recover(); err != nil {
+			Q.errFunc(e.Name, err)
+			failure = ErrPanicked
 		}
-		// Remove the element
-		func() {
-			Q.execLock.Lock()
-			defer Q.execLock.Unlock()
-			for i, elem := range Q.execElements {
-				if elem == e {
-					Q.execElements = append(Q.execElements[:i], Q.execElements[i+1:]...)
-					break
-				}
-			}
-		}()
+		Q.complete(e, r, results, failure)
 		// Broadcast the now empty slot in execElements
 		Q.waitCond.L.Lock()
 		defer Q.waitCond.L.Unlock()
+		Q.updateState()
 		Q.waitCond.Broadcast()
 	}()
-	// Execute the function and return it in a defer (in case it panics)
-	var r string
-	defer func() { e.OutChannel.Return(r) }()
-	r = Q.function(e.Name, e.Data)
+	if itemFunc != nil {
+		results = itemFunc(e.Name, e.Data)
+		if results == nil {
+			// No results at all, rather than the result of the queue function
+			results = []string{}
+		}
+	} else {
+		r, results, failure = runJob(context.Background(), f, e.Name, e.Data, e.Metadata)
+	}
+}
+
+// Execute a batch of elements with one call of f
+func (Q *SAPIQueue) execBatch(batch []*Element, f QueueJobFunction) {
+	// Execute the function and return the results in a defer (in case it panics)
+	var results []string
+	jobs := make([]*Job, len(batch))
+	defer func() {
+		var failure error
+		if err := recover(); err != nil {
+			for _, e := range batch {
+				Q.errFunc(e.Name, err)
+			}
+			// As with a single element, a panicked batch fails each element
+			failure = ErrPanicked
+		}
+		for i, e := range batch {
+			var r string
+			var items []string
+			err := failure
+			if err == nil && jobs[i].Results != nil {
+				items = jobs[i].Results
+			} else if i < len(results) {
+				r = results[i]
+			} else if err == nil {
+				err = ErrNoResult
+			}
+			Q.complete(e, r, items, err)
+		}
+		// Broadcast the now empty slot
+		Q.waitCond.L.Lock()
+		defer Q.waitCond.L.Unlock()
+		Q.execLock.Lock()
+		Q.execBatches--
+		Q.execLock.Unlock()
+		Q.updateState()
+		Q.waitCond.Broadcast()
+	}()
+	for i, e := range batch {
+		jobs[i] = &Job{Name: e.Name, Data: e.Data, Metadata: e.Metadata}
+	}
+	results = f(context.Background(), jobs)
+}
+
+// Return the result of an executed element, or fail it with err, and remove it
+// from the executing elements
+func (Q *SAPIQueue) complete(e *Element, r string, results []string, err error) {
+	var done []Completion
+	if err != nil {
+		done = e.failAll(err)
+	} else if results != nil {
+		done = e.returnItems(results)
+	} else {
+		done = e.returnAll(r)
+	}
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	for i, elem := range Q.execElements {
+		if elem == e {
+			Q.execElements = append(Q.execElements[:i], Q.execElements[i+1:]...)
+			break
+		}
+	}
+	if Q.report != nil {
+		Q.report.Completed = append(Q.report.Completed, e.Name)
+	}
+	for _, C := range Q.completions {
+		C.add(e.Name, done)
+	}
 }
 
 func (Q *SAPIQueue) execTopElement() bool {
@@ -92,14 +183,19 @@ func (Q *SAPIQueue) execTopElement() bool {
 			}
 			return found
 		}()
-		if !found {
+		if !found && !Q.isLingering(e) {
 			if e == Q.elements.Front {
 				Q.elements.Pop()
 			} else {
 				Q.elements.RemoveElement(e)
 			}
 			Q.execElements = append(Q.execElements, e)
-			go Q.exec(e)
+			if Q.batchFunc != nil {
+				// Collect the element into the batch being dispatched
+				Q.batch = append(Q.batch, e)
+			} else {
+				go Q.exec(e, Q.function, Q.itemFunc)
+			}
 			return true
 		}
 		e = e.Next
@@ -109,20 +205,218 @@ func (Q *SAPIQueue) execTopElement() bool {
 
 // Insert an element into the queue. If an element of that name already
 // exists, the data will be appended into a list.
+// If the queue is at capacity the element is handled by its FullPolicy, and
+// if the element is rejected its SafeReturn holds an empty result. Likewise
+// if the data would exceed the memory budget. AddElementResult returns the
+// error, such as ErrFull or ErrOverBudget, instead.
 // If the queue is closed AddElement will panic.
-func (Q *SAPIQueue) AddElement(Name string, Data ...string) (sr SafeReturn) {
-	if Q.closed {
+func (Q *SAPIQueue) AddElement(Name string, Data ...string) SafeReturn {
+	sr, err := Q.addElement(context.Background(), Name, Data, nil, false, contribution{})
+	if err == ErrClosed {
+		panic("Unable to add element. Queue is closed")
+	}
+	return sr
+}
+
+// Insert an element into the queue as with AddElement, merging Metadata into
+// the metadata of the element, which is given to a QueueJobFunction.
+// Values added later replace those of the same keys added earlier.
+func (Q *SAPIQueue) AddElementWithMetadata(Name string, Metadata map[string]string, Data ...string) SafeReturn {
+	sr, err := Q.addElement(context.Background(), Name, Data, Metadata, false, contribution{})
+	if err == ErrClosed {
 		panic("Unable to add element. Queue is closed")
 	}
+	return sr
+}
+
+// Insert an element into the queue as with AddElement. If the queue is at
+// capacity or memory budget and blocks when full, AddElementContext waits until
+// there is space, or returns ctx.Err() once ctx is done. If the element is
+// rejected, it returns ErrFull or ErrOverBudget, and if the queue is closed,
+// ErrClosed. On error, the SafeReturn already holds an empty result.
+func (Q *SAPIQueue) AddElementContext(ctx context.Context, Name string, Data ...string) (SafeReturn, error) {
+	return Q.addElement(ctx, Name, Data, nil, false, contribution{})
+}
+
+// Insert an element into the queue as with AddElement, without blocking or
+// panicking. If the queue has no space, TryAddElement returns ErrFull or
+// ErrOverBudget whatever the policy (unless evicting makes space). If the queue
+// is closed it returns ErrClosed, and if it is stopped, ErrStopped. On error,
+// the SafeReturn already holds an empty result.
+func (Q *SAPIQueue) TryAddElement(Name string, Data ...string) (SafeReturn, error) {
+	return Q.addElement(context.Background(), Name, Data, nil, true, contribution{})
+}
+
+// Insert an element into the queue as with AddElementContext, merging Metadata
+// into the metadata of the element as AddElementWithMetadata does
+func (Q *SAPIQueue) AddElementContextWithMetadata(ctx context.Context, Name string, Metadata map[string]string, Data ...string) (SafeReturn, error) {
+	return Q.addElement(ctx, Name, Data, Metadata, false, contribution{})
+}
+
+// Insert an element into the queue as with TryAddElement, merging Metadata
+// into the metadata of the element as AddElementWithMetadata does
+func (Q *SAPIQueue) TryAddElementWithMetadata(Name string, Metadata map[string]string, Data ...string) (SafeReturn, error) {
+	return Q.addElement(context.Background(), Name, Data, Metadata, true, contribution{})
+}
+
+// Insert an element into the queue as with AddElementContext, returning a
+// Handle on the data added. The Handle receives the result of the data or an
+// error, such as ErrFull, ErrClosed or ErrEvicted, and can withdraw the data
+// while it is waiting.
+func (Q *SAPIQueue) AddElementResult(ctx context.Context, Name string, Data ...string) Handle {
+	H := makeHandle()
+	Q.addElement(ctx, Name, Data, nil, false, contribution{handle: H.result})
+	return H
+}
+
+// Insert an element, with c as the contribution of the data, which with try
+// fails rather than waiting for space, or being added to a stopped queue
+func (Q *SAPIQueue) addElement(ctx context.Context, Name string, Data []string, Metadata map[string]string, try bool, c contribution) (SafeReturn, error) {
 	Q.waitCond.L.Lock()
 	defer Q.waitCond.L.Unlock()
+	if !try && Q.checkBlocked(Name, Data) {
+		// Wake up to check ctx once it is done
+		stop := context.AfterFunc(ctx, func() {
+			Q.waitCond.L.Lock()
+			defer Q.waitCond.L.Unlock()
+			Q.waitCond.Broadcast()
+		})
+		defer stop()
+		for Q.checkBlocked(Name, Data) {
+			if err := ctx.Err(); err != nil {
+				c.resolve("", err)
+				return emptyReturn(), err
+			}
+			Q.waitCond.Wait()
+		}
+	}
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
+	if Q.closed {
+		c.resolve("", ErrClosed)
+		return emptyReturn(), ErrClosed
+	}
+	if try && (Q.state == StateStopping || Q.state == StateStopped) {
+		c.resolve("", ErrStopped)
+		return emptyReturn(), ErrStopped
+	}
+	sr, err := Q.insert(ctx, Name, Data, Metadata, c)
+	if err != nil {
+		c.resolve("", err)
+		return emptyReturn(), err
+	}
+	// Broadcast that the queue might be non-empty
+	Q.waitCond.Broadcast()
+	return sr, nil
+}
+
+// Insert an element with c as the contribution of its data, if there is space
+// for it, evicting another to make space if the policy allows. Requires Q.lock
+func (Q *SAPIQueue) insert(ctx context.Context, Name string, Data []string, Metadata map[string]string, c contribution) (SafeReturn, error) {
+	// Make space for the element
+	err := Q.hasSpace(Name, Data)
+	if err == ErrFull && Q.fullPolicy == EvictWhenFull {
+		// Evict the oldest element
+		for _, e := range Q.elements.drop(Q.elements.Front) {
+			e.failAll(ErrEvicted)
+		}
+		err = Q.hasSpace(Name, Data)
+	}
+	if err != nil {
+		return nil, err
+	}
 	// Add the element
-	sr = Q.elements.AddElement(Name, Data...)
+	if c.handle != nil {
+		c.handle.owner = Q
+		c.handle.name = Name
+	}
+	if Q.dropAbandoned && ctx.Done() != nil {
+		// The caller waits on the element until ctx is done
+		w := &watchers{waiters: 1}
+		w.watch = func(ctx context.Context) { Q.watch(Name, w, ctx) }
+		w.stops = append(w.stops, context.AfterFunc(ctx, func() { Q.release(Name, w) }))
+		c.waiters = w
+		if c.handle != nil {
+			c.handle.watchers = w
+		}
+	}
+	if (Q.itemFunc != nil || Q.jobs) && c.handle == nil {
+		// The caller receives the result of its own data
+		c.out = make(SafeReturn, 1)
+	}
+	if c.handle == nil && c.waiters == nil && c.out == nil {
+		// The caller shares the result of the element
+		return Q.elements.insert(Name, Metadata, Data, nil), nil
+	}
+	return Q.elements.insert(Name, Metadata, Data, &c), nil
+}
+
+// Insert a batch of elements into the queue as with AddElement, taking the
+// lock and waking the queue once for the whole batch. Rather than block when
+// the queue is full, an element which does not fit is rejected, and its
+// SafeReturn holds an empty result. Returns the SafeReturn of each element, in
+// the same order.
+// If the queue is closed AddElements will panic.
+func (Q *SAPIQueue) AddElements(items []Item) []SafeReturn {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.closed {
+		panic("Unable to add elements. Queue is closed")
+	}
+	srs := make([]SafeReturn, len(items))
+	for i, item := range items {
+		sr, err := Q.insert(context.Background(), item.Name, item.Data, item.Metadata, contribution{})
+		if err != nil {
+			sr = emptyReturn()
+		}
+		srs[i] = sr
+	}
 	// Broadcast that the queue might be non-empty
 	Q.waitCond.Broadcast()
-	return
+	return srs
+}
+
+// Withdraw the data added with r from the waiting element of the name, and
+// wake the queue to the space freed
+func (Q *SAPIQueue) withdraw(Name string, r *result) bool {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	withdrawn := Q.elements.withdraw(Name, r)
+	Q.lock.Unlock()
+	if withdrawn {
+		Q.updateState()
+		Q.waitCond.Broadcast()
+	}
+	return withdrawn
+}
+
+// Count a waiter on data with the waiters w until ctx is done, if the data
+// is still waiting
+func (Q *SAPIQueue) watch(Name string, w *watchers, ctx context.Context) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if !Q.elements.holds(Name, w) {
+		return
+	}
+	w.waiters++
+	w.stops = append(w.stops, context.AfterFunc(ctx, func() { Q.release(Name, w) }))
+}
+
+// Count a waiter in w as gone, and remove its element if no waiters are left
+func (Q *SAPIQueue) release(Name string, w *watchers) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	w.waiters--
+	dropped := w.waiters == 0 && Q.elements.dropAbandoned(Name)
+	Q.lock.Unlock()
+	if dropped {
+		Q.updateState()
+		Q.waitCond.Broadcast()
+	}
 }
 
 // Update the limit on the number of simultaneously executing
@@ -135,69 +429,633 @@ func (Q *SAPIQueue) SetLimit(limit int) {
 	Q.waitCond.Broadcast()
 }
 
+// Set the handler function for elements to one which is given a context
+func (Q *SAPIQueue) SetContextFunction(f QueueContextFunction) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.function = contextJobFunction(f)
+}
+
+// Set a handler function which returns the result of each data item of an
+// element, in place of the queue function. The SafeReturn (or Handle) of each
+// add call then resolves with the result of its own data items (the last, if it
+// added several), rather than one result shared by the element. A nil f uses
+// the queue function again.
+func (Q *SAPIQueue) SetItemFunction(f QueueItemFunction) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.itemFunc = f
+}
+
+// Set the maximum number of elements waiting in the queue, and what to do
+// when adding an element to a full queue. Adding data to an element which is
+// already waiting always succeeds. Zero capacity removes the maximum.
+func (Q *SAPIQueue) SetCapacity(capacity int, policy FullPolicy) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.capacity = capacity
+	Q.fullPolicy = policy
+	Q.waitCond.Broadcast()
+}
+
+// Set the maximum total size in bytes of the data waiting in the queue, and
+// of the data of each waiting element, and what to do when adding data which
+// would exceed either. Each follow-on chunk of an element is charged
+// separately. Data which could never fit is always rejected, and
+// EvictWhenFull rejects as RejectWhenFull does. Zero removes a maximum.
+func (Q *SAPIQueue) SetMemoryBudget(queueBytes, elementBytes int, policy FullPolicy) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.byteBudget = queueBytes
+	Q.elementBudget = elementBytes
+	Q.budgetPolicy = policy
+	Q.waitCond.Broadcast()
+}
+
+// Execute elements in batches of up to size with f, in place of the queue
+// function. Each batch takes the elements in the order they would otherwise
+// run, none of them with the same name, and the limit is instead on the
+// number of batches executing at once. A nil f executes elements one at a
+// time again.
+func (Q *SAPIQueue) SetBatchFunction(f QueueBatchFunction, size int) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.batchFunc = batchJobFunction(f)
+	Q.batchSize = max(size, 1)
+	Q.waitCond.Broadcast()
+}
+
+// Set the handler function for elements to f, which is given each element
+// with its metadata. With size above 1, f executes batches of up to size
+// elements as SetBatchFunction does, and otherwise one element at a time
+// with a context, as SetContextFunction does. A job whose Results f sets
+// returns the result of each of its data items, as SetItemFunction does.
+func (Q *SAPIQueue) SetJobFunction(f QueueJobFunction, size int) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.jobs = true
+	if size > 1 {
+		Q.batchFunc = f
+		Q.batchSize = size
+	} else {
+		Q.function = f
+		Q.batchFunc = nil
+	}
+	Q.waitCond.Broadcast()
+}
+
+// Set how long elements wait to collect more data before they can execute
+func (Q *SAPIQueue) SetLinger(l Linger) {
+	Q.SetLingerFunc(func(name string) Linger { return l })
+}
+
+// Set how long each element waits to collect more data before it can
+// execute, by name. A nil f executes elements without waiting.
+func (Q *SAPIQueue) SetLingerFunc(f func(name string) Linger) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.linger = f
+	Q.waitCond.Broadcast()
+}
+
+// Set the maximum number of data items in each element. Further data for
+// the name of a full element goes into a follow-on element, which takes its
+// place in the queue once it starts executing, and so executes after it.
+// Follow-on elements do not count toward the capacity. Zero removes the
+// maximum.
+func (Q *SAPIQueue) SetMaxDataPerElement(n int) {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.elements.maxData = n
+	Q.waitCond.Broadcast()
+}
+
+// Set whether to remove waiting elements once all of their waiters have
+// gone. Each element added with AddElementContext or AddElementResult then
+// waits on its ctx, and each call to ResultContext on its Handle adds a
+// waiter until its ctx is done. Elements added with AddElement or TryAddElement are always waited on.
+// Once the last waiter of an element has gone, it is removed from the queue
+// and fails with ErrAbandoned. This applies to elements added after it is set.
+func (Q *SAPIQueue) SetDropAbandoned(drop bool) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.dropAbandoned = drop
+}
+
 // Set a new error handling function, which handles panics encountered
 // When executing elements. By default this is a log.Println
+// The panicked elements then fail with ErrPanicked.
 func (Q *SAPIQueue) SetErrorFunc(errFunc QueueErrFunction) {
 	Q.errFunc = errFunc
 }
 
+// Returns the lifecycle state of the queue
+func (Q *SAPIQueue) State() State {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.state
+}
+
+// Returns the lifecycle state of the queue, and a channel which
+// is closed when the state next changes
+func (Q *SAPIQueue) WatchState() (State, <-chan struct{}) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.state, Q.changed
+}
+
 // Stops the execution of the queue. Currently executing elements
 // will continue to run, but no enqueued elements will start executing.
-// You must re-run Run to start the queue again.
+// You must re-run Run to start the queue again. Enqueued elements wait for
+// it, unless StopAndDump is used to remove them and release their waiters.
 func (Q *SAPIQueue) Stop() {
-	Q.stopped = true
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	if Q.state != StateStopped && Q.state != StateClosed {
+		Q.setState(StateStopping)
+	}
+	Q.lock.Unlock()
+	Q.updateState()
+}
+
+// Stops the queue as Stop does, and removes all enqueued elements as
+// DumpElements does, failing them with ErrDropped to release their waiters
+func (Q *SAPIQueue) StopAndDump() []*Element {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	Q.lock.Lock()
+	if Q.state != StateStopped && Q.state != StateClosed {
+		Q.setState(StateStopping)
+	}
+	r := Q.elements.DumpElements()
+	Q.lock.Unlock()
+	Q.updateState()
+	return r
+}
+
+// Pauses the running queue. Elements can still be added, and currently
+// executing elements will continue to run, but no enqueued elements will
+// start executing until Resume is called.
+func (Q *SAPIQueue) Pause() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.state == StateRunning {
+		Q.setState(StatePaused)
+	}
+}
+
+// Resumes executing elements in a paused queue
+func (Q *SAPIQueue) Resume() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.state == StatePaused {
+		Q.setState(StateRunning)
+	}
 }
 
 // Closes the queue to prevent more elements from being enqueued.
-// If an new element is attempted to be added, AddElement will panic.
+// If an new element is attempted to be added, AddElement will panic,
+// and AddElementContext and TryAddElement return ErrClosed.
 // There is no way to re-open a queue once closed.
 func (Q *SAPIQueue) Close() {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
 	Q.closed = true
+	Q.lock.Unlock()
+	Q.updateState()
+	Q.waitCond.Broadcast()
 }
 
 // Waits for the queue to finish stopping/closing. Use after calling Stop or Close.
-// If only stopped, Wait will wait until all executing elements have completed.
-// If closed, Wait will wait until the queue is empty.
+// If stopped, Wait will wait until all executing elements have completed.
+// If only closed, Wait will wait until the queue is empty, or is stopped.
 func (Q *SAPIQueue) Wait() {
-	if Q.stopped {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	for Q.state == StateStopping || (Q.closed && Q.state != StateStopped && Q.state != StateClosed) {
+		Q.waitCond.Wait()
+	}
+}
+
+// Closes the queue and waits for Run to execute the remaining elements.
+// Once ctx is done (or the queue is stopped), the elements still waiting are
+// removed and fail with ErrShutdown. Elements executing at that point are
+// not waited for. Returns the names of the elements which were completed
+// during the shutdown, canceled, and still running.
+func (Q *SAPIQueue) Shutdown(ctx context.Context) ShutdownReport {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	report := new(ShutdownReport)
+	func() {
+		Q.lock.Lock()
+		defer Q.lock.Unlock()
+		Q.execLock.Lock()
+		defer Q.execLock.Unlock()
+		Q.closed = true
+		Q.report = report
+	}()
+	Q.waitCond.Broadcast()
+	// Wake up to check ctx once it is done
+	stop := context.AfterFunc(ctx, func() {
 		Q.waitCond.L.Lock()
+		defer Q.waitCond.L.Unlock()
+		Q.waitCond.Broadcast()
+	})
+	defer stop()
+	for Q.state != StateStopping && Q.state != StateStopped && ctx.Err() == nil && !Q.checkEmpty() {
+		Q.waitCond.Wait()
+	}
+	Q.lock.Lock()
+	Q.execLock.Lock()
+	for _, e := range Q.elements.dump() {
+		report.Canceled = append(report.Canceled, e.Name)
+		e.failAll(ErrShutdown)
+	}
+	for _, e := range Q.execElements {
+		report.Running = append(report.Running, e.Name)
+	}
+	Q.report = nil
+	Q.execLock.Unlock()
+	Q.lock.Unlock()
+	Q.updateState()
+	return *report
+}
+
+// Returns the number of elements waiting in the queue, and
+// the number of currently executing elements
+func (Q *SAPIQueue) NumElements() (int, int) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	return len(Q.elements.NameIndex), len(Q.execElements)
+}
+
+// Returns the total size in bytes of the data waiting in the queue,
+// and of the data of currently executing elements
+func (Q *SAPIQueue) NumBytes() (int, int) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.execLock.Lock()
+	defer Q.execLock.Unlock()
+	executing := 0
+	for _, e := range Q.execElements {
+		executing += e.size
+	}
+	return Q.elements.Bytes(), executing
+}
+
+// Returns an iterator over copies of the elements waiting in the queue, in
+// the order they would execute, except that each is followed directly by its
+// follow-on chunks. The queue is locked for each element rather than for the
+// whole iteration, so changes to the queue while iterating may not be seen.
+func (Q *SAPIQueue) All() iter.Seq[*Element] {
+	return func(yield func(*Element) bool) {
+		seen := make(map[*Element]bool)
+		var e *Element
 		for {
-			if Q.checkExecEmpty() {
-				break
+			var elements []*Element
+			e, elements = Q.nextWaiting(e, seen)
+			if e == nil {
+				return
+			}
+			for _, c := range elements {
+				if !yield(c) {
+					return
+				}
 			}
-			Q.waitCond.Wait()
 		}
-		Q.waitCond.L.Unlock()
 	}
-	if Q.closed {
-		Q.waitCond.L.Lock()
+}
+
+// Finds the first waiting element after prev (or from the front, if prev is
+// no longer waiting) which has not been seen, and returns it along with
+// copies of it and its follow-on chunks
+func (Q *SAPIQueue) nextWaiting(prev *Element, seen map[*Element]bool) (*Element, []*Element) {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	e := Q.elements.Front
+	if prev != nil && Q.elements.NameIndex[prev.Name] == prev {
+		e = prev.Next
+	}
+	for e != nil && seen[e] {
+		e = e.Next
+	}
+	if e == nil {
+		return nil, nil
+	}
+	seen[e] = true
+	elements := []*Element{e.copy()}
+	for _, c := range e.chunks {
+		// Chunks are seen here, rather than once they are promoted
+		seen[c] = true
+		elements = append(elements, c.copy())
+	}
+	return e, elements
+}
+
+// Returns an iterator over the names and results of elements as they finish,
+// from when iteration starts until ctx is done or the queue is closed. An
+// element run with an item function yields the result of each add call.
+func (Q *SAPIQueue) Completed(ctx context.Context) iter.Seq2[string, Completion] {
+	return func(yield func(string, Completion) bool) {
+		C := newCompletions()
+		Q.execLock.Lock()
+		Q.completions = append(Q.completions, C)
+		Q.execLock.Unlock()
+		defer func() {
+			Q.execLock.Lock()
+			defer Q.execLock.Unlock()
+			for i, c := range Q.completions {
+				if c == C {
+					Q.completions = append(Q.completions[:i], Q.completions[i+1:]...)
+					break
+				}
+			}
+		}()
 		for {
-			if Q.checkEmpty() {
-				break
+			// Elements have all finished by the time the queue is closed
+			state, changed := Q.WatchState()
+			names, results := C.take()
+			for i := range names {
+				if !yield(names[i], results[i]) {
+					return
+				}
+			}
+			if state == StateClosed {
+				return
+			}
+			select {
+			case <-C.ready:
+			case <-changed:
+			case <-ctx.Done():
+				return
 			}
-			Q.waitCond.Wait()
 		}
-		Q.waitCond.L.Unlock()
 	}
 }
 
-// Returns the number of elements waiting in the queue, and
-// the number of currently executing elements
-func (Q *SAPIQueue) NumElements() (int, int) {
+// Move the waiting element of the name to the front of the queue, to run
+// next. Returns false if there is none.
+func (Q *SAPIQueue) MoveToFront(name string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.MoveToFront(name)
+}
+
+// Move the waiting element of the name to the back of the queue, to run
+// last. Returns false if there is none.
+func (Q *SAPIQueue) MoveToBack(name string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.MoveToBack(name)
+}
+
+// Move the waiting element of the name to just before the waiting element of
+// other. Returns false if either is not waiting, or they are the same.
+func (Q *SAPIQueue) MoveBefore(name, other string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.MoveBefore(name, other)
+}
+
+// Returns the number of waiting elements whose names match, such as
+// with MatchPrefix
+func (Q *SAPIQueue) CountMatching(match func(name string) bool) int {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return len(Q.elements.matching(match))
+}
+
+// Removes the waiting elements whose names match, as one operation, and
+// fails them with ErrCanceled. Returns how many there were.
+func (Q *SAPIQueue) CancelMatching(match func(name string) bool) int {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	Q.lock.Lock()
+	matched := Q.elements.matching(match)
+	for _, e := range matched {
+		for _, d := range Q.elements.drop(e) {
+			d.failAll(ErrCanceled)
+		}
+	}
+	Q.lock.Unlock()
+	Q.updateState()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	return len(matched)
+}
+
+// Returns copies of the elements waiting in the queue, in the order they
+// would execute, and of the currently executing elements
+func (Q *SAPIQueue) Snapshot() ([]*Element, []*Element) {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
 	Q.execLock.Lock()
 	defer Q.execLock.Unlock()
-	return len(Q.elements.NameIndex), len(Q.execElements)
+	executing := make([]*Element, len(Q.execElements))
+	for i, e := range Q.execElements {
+		executing[i] = e.copy()
+	}
+	return Q.elements.Snapshot(), executing
 }
 
-// Removes all elements from the queue and returns them as a slice
+// Removes all elements from the queue in the order they would execute,
+// and returns them as a slice, failing them with ErrDropped so that anything
+// waiting on them is released
+func (Q *SAPIQueue) Drain() []*Element {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	defer Q.updateState()
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	return Q.elements.Drain()
+}
+
+// Removes all elements from the queue and returns them as a slice, failing
+// them with ErrDropped so that anything waiting on them is released
 func (Q *SAPIQueue) DumpElements() []*Element {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	defer Q.updateState()
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
 	return Q.elements.DumpElements()
 }
 
+// Whether there is space to add Data to the element of the name. Returns
+// ErrFull if there is no space for a new element, or ErrOverBudget if the
+// data would exceed the memory budget.
+func (Q *SAPIQueue) hasSpace(Name string, Data []string) error {
+	_, ok := Q.elements.NameIndex[Name]
+	if !ok && Q.capacity > 0 && len(Q.elements.NameIndex) >= Q.capacity {
+		return ErrFull
+	}
+	if Q.byteBudget > 0 && Q.elements.Bytes()+dataSize(Data) > Q.byteBudget {
+		return ErrOverBudget
+	}
+	if Q.elementBudget > 0 && Q.chunkSize(Q.elements.receiver(Name), Data) > Q.elementBudget {
+		return ErrOverBudget
+	}
+	return nil
+}
+
+// The size in bytes of the largest chunk which Data goes into, when added to
+// e, or to a new element if e is nil. Each chunk is charged separately.
+func (Q *SAPIQueue) chunkSize(e *Element, Data []string) int {
+	size, n, largest := 0, 0, 0
+	if e != nil {
+		size, n, largest = e.size, len(e.Data), e.size
+	}
+	for _, d := range Data {
+		if Q.elements.maxData > 0 && n >= Q.elements.maxData {
+			size, n = 0, 0
+		}
+		size += len(d)
+		n++
+		largest = max(largest, size)
+	}
+	return largest
+}
+
+// Whether adding Data to the element of the name must wait for space
+func (Q *SAPIQueue) checkBlocked(Name string, Data []string) bool {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	if Q.closed {
+		return false
+	}
+	switch Q.hasSpace(Name, Data) {
+	case ErrFull:
+		return Q.fullPolicy == BlockWhenFull
+	case ErrOverBudget:
+		// Only wait if the data fits into an empty queue
+		fits := (Q.byteBudget <= 0 || dataSize(Data) <= Q.byteBudget) && (Q.elementBudget <= 0 || Q.chunkSize(nil, Data) <= Q.elementBudget)
+		return Q.budgetPolicy == BlockWhenFull && fits
+	}
+	return false
+}
+
+// Set the state, and signal the change. Requires Q.waitCond.L and Q.lock
+func (Q *SAPIQueue) setState(state State) {
+	if Q.state == state {
+		return
+	}
+	Q.state = state
+	close(Q.changed)
+	Q.changed = make(chan struct{})
+	Q.waitCond.Broadcast()
+}
+
+// Move on to Stopped or Closed once the queue is done with its elements.
+// Requires Q.waitCond.L
+func (Q *SAPIQueue) updateState() {
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.execLock.Lock()
+	executing := len(Q.execElements) > 0
+	Q.execLock.Unlock()
+	if Q.closed && len(Q.elements.NameIndex) == 0 && !executing {
+		Q.setState(StateClosed)
+	} else if Q.state == StateStopping && !executing && !Q.looping {
+		Q.setState(StateStopped)
+	}
+}
+
+// Start a Run loop, unless one is already active or the queue is closed.
+// Requires Q.waitCond.L
+func (Q *SAPIQueue) startRun() bool {
+	// Let a stopping loop exit first
+	for Q.looping && Q.state != StateRunning && Q.state != StatePaused {
+		Q.waitCond.Wait()
+	}
+	if Q.looping || Q.state == StateClosed {
+		return false
+	}
+	Q.looping = true
+	Q.lock.Lock()
+	defer Q.lock.Unlock()
+	Q.setState(StateRunning)
+	return true
+}
+
+// End a Run loop. Requires Q.waitCond.L
+func (Q *SAPIQueue) endRun() {
+	Q.looping = false
+	// Nothing waits for lingering elements until the queue runs again
+	Q.lock.Lock()
+	if Q.lingerTimer != nil {
+		Q.lingerTimer.Stop()
+	}
+	Q.lock.Unlock()
+	Q.updateState()
+	Q.waitCond.Broadcast()
+}
+
+// Whether e is still waiting for more data. Keeps track of when the first
+// lingering element can execute in Q.lingerUntil. Requires Q.lock
+func (Q *SAPIQueue) isLingering(e *Element) bool {
+	if Q.linger == nil {
+		return false
+	}
+	l := Q.linger(e.Name)
+	if l.MaxData > 0 && len(e.Data) >= l.MaxData {
+		return false
+	}
+	until := e.updated.Add(l.Quiet)
+	if l.MaxWait > 0 && e.added.Add(l.MaxWait).Before(until) {
+		until = e.added.Add(l.MaxWait)
+	}
+	if !time.Now().Before(until) {
+		return false
+	}
+	if Q.lingerUntil.IsZero() || until.Before(Q.lingerUntil) {
+		Q.lingerUntil = until
+	}
+	return true
+}
+
+// Wake the queue once the first lingering element can execute. Requires Q.lock
+func (Q *SAPIQueue) wakeForLinger() {
+	if Q.lingerUntil.IsZero() {
+		return
+	}
+	d := time.Until(Q.lingerUntil)
+	if Q.lingerTimer == nil {
+		Q.lingerTimer = time.AfterFunc(d, func() {
+			Q.waitCond.L.Lock()
+			defer Q.waitCond.L.Unlock()
+			Q.waitCond.Broadcast()
+		})
+	} else {
+		Q.lingerTimer.Reset(d)
+	}
+}
+
 func (Q *SAPIQueue) checkEmpty() bool {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
@@ -217,36 +1075,69 @@ func (Q *SAPIQueue) checkExecEmpty() bool {
 func (Q *SAPIQueue) checkExec() bool {
 	Q.lock.Lock()
 	defer Q.lock.Unlock()
+	Q.lingerUntil = time.Time{}
+	defer Q.wakeForLinger()
 	if Q.elements.Front == nil {
 		return false
 	}
 	Q.execLock.Lock()
 	defer Q.execLock.Unlock()
-	if len(Q.execElements) >= Q.limit {
-		return false
+	if Q.batchFunc != nil {
+		if Q.execBatches >= Q.limit {
+			return false
+		}
+		for len(Q.batch) < Q.batchSize && Q.execTopElement() {
+		}
+		if len(Q.batch) == 0 {
+			return false
+		}
+		Q.execBatches++
+		go Q.execBatch(Q.batch, Q.batchFunc)
+		Q.batch = nil
+	} else {
+		if len(Q.execElements) >= Q.limit {
+			return false
+		}
+		if !Q.execTopElement() {
+			return false
+		}
 	}
-	return Q.execTopElement()
+	// Broadcast the space in the queue
+	Q.waitCond.Broadcast()
+	return true
 }
 
 // Run the queue, executing elements over set intervals.
-// Will loop forever (until stopped), so spawn this in a new thread.
+// Will loop until stopped or closed, so spawn this in a new thread. If the
+// queue is already running, Run returns immediately.
 func (Q *SAPIQueue) Run(Wait time.Duration) {
-	Q.stopped = false
-	a := time.Tick(Wait)
-	for _ = range a {
+	Q.waitCond.L.Lock()
+	defer Q.waitCond.L.Unlock()
+	if !Q.startRun() {
+		return
+	}
+	defer Q.endRun()
+	ticker := time.NewTicker(Wait)
+	defer ticker.Stop()
+	for {
+		// Wait for the next tick, or for the state to change
+		changed := Q.changed
+		Q.waitCond.L.Unlock()
+		ticked := false
+		select {
+		case <-ticker.C:
+			ticked = true
+		case <-changed:
+		}
+		Q.waitCond.L.Lock()
 		// Wait for non-empty queue and wait for an open space
 		// and wait for an element with a name that doesn't match
-		// any currently executing elements
-		Q.waitCond.L.Lock()
-		for !Q.stopped {
-			if Q.checkExec() {
-				break
-			}
+		// any currently executing elements, and while paused
+		for ticked && (Q.state == StatePaused || (Q.state == StateRunning && !Q.checkExec())) {
 			Q.waitCond.Wait()
 		}
-		Q.waitCond.L.Unlock()
-		if Q.stopped {
-			break
+		if Q.state != StateRunning && Q.state != StatePaused {
+			return
 		}
 	}
 }
@@ -22,7 +22,11 @@ package sapip_bytes
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -131,6 +135,1382 @@ func TestSai(t *testing.T) {
 	wg.Wait()
 }
 
+func TestSaipAging(t *testing.T) {
+	fmt.Println("Testing SAIP queue aging")
+	order := make([]string, 0)
+	RecordCommand := func(name []byte, data [][]byte) []byte {
+		order = append(order, string(name))
+		return nil
+	}
+	AgingSAIPQueue := NewSAIPQueue(RecordCommand, 1)
+	AgingSAIPQueue.SetAging(10 * time.Millisecond)
+	AgingSAIPQueue.AddElement([]byte("old"), nil, 5)
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		AgingSAIPQueue.AddElement(Uint32ToByteArray(uint32(i)), nil, 0)
+	}
+	if waiting, _ := AgingSAIPQueue.Snapshot(); len(waiting) != 6 || string(waiting[0].Name) != "old" {
+		t.Error("Expected aged element to be first in the snapshot")
+	}
+	all := make([]string, 0)
+	for e := range AgingSAIPQueue.All() {
+		all = append(all, string(e.Name))
+	}
+	if len(all) != 6 || all[0] != "old" {
+		t.Error("Expected aged element to be first in All, got:", all)
+	}
+	go AgingSAIPQueue.Run()
+	AgingSAIPQueue.Close()
+	AgingSAIPQueue.Wait()
+	if len(order) != 6 || order[0] != "old" {
+		t.Error("Expected aged element to run first, got:", order)
+	}
+}
+
+func TestSaipOrdering(t *testing.T) {
+	fmt.Println("Testing SAIP queue with custom ordering")
+	type TierDeadline struct {
+		Tier     int
+		Deadline int
+	}
+	less := func(a, b TierDeadline) bool {
+		if a.Tier != b.Tier {
+			return a.Tier < b.Tier
+		}
+		return a.Deadline < b.Deadline
+	}
+	order := make([]string, 0)
+	RecordCommand := func(name []byte, data [][]byte) []byte {
+		order = append(order, string(name))
+		return nil
+	}
+	OrderedSAIPQueue := NewSAIPQueueOf(RecordCommand, 1, less)
+	OrderedSAIPQueue.AddElement([]byte("d"), nil, TierDeadline{1, 5})
+	OrderedSAIPQueue.AddElement([]byte("b"), nil, TierDeadline{0, 9})
+	OrderedSAIPQueue.AddElement([]byte("e"), nil, TierDeadline{1, 5})
+	OrderedSAIPQueue.AddElement([]byte("a"), nil, TierDeadline{0, 3})
+	OrderedSAIPQueue.AddElement([]byte("c"), nil, TierDeadline{1, 1})
+	OrderedSAIPQueue.AddElement([]byte("e"), nil, TierDeadline{1, 2})
+	go OrderedSAIPQueue.Run()
+	OrderedSAIPQueue.Close()
+	OrderedSAIPQueue.Wait()
+	if strings.Join(order, "") != "abced" {
+		t.Error("Expected order abced, got:", order)
+	}
+}
+
+func TestSaipEqualOrdering(t *testing.T) {
+	fmt.Println("Testing SAIP queue with equally ordered priorities")
+	type TierID struct {
+		Tier int
+		ID   int
+	}
+	less := func(a, b TierID) bool { return a.Tier < b.Tier }
+	order := make([]string, 0)
+	RecordCommand := func(name []byte, data [][]byte) []byte {
+		order = append(order, string(name))
+		return nil
+	}
+	OrderedSAIPQueue := NewSAIPQueueOf(RecordCommand, 1, less)
+	OrderedSAIPQueue.AddElement([]byte("b"), nil, TierID{1, 1})
+	OrderedSAIPQueue.AddElement([]byte("c"), nil, TierID{1, 2})
+	OrderedSAIPQueue.AddElement([]byte("d"), nil, TierID{1, 3})
+	OrderedSAIPQueue.AddElement([]byte("a"), nil, TierID{0, 4})
+	OrderedSAIPQueue.AddElement([]byte("e"), nil, TierID{1, 3})
+	go OrderedSAIPQueue.Run()
+	OrderedSAIPQueue.Close()
+	OrderedSAIPQueue.Wait()
+	if strings.Join(order, "") != "abcde" {
+		t.Error("Expected order abcde, got:", order)
+	}
+}
+
+func TestSaipEDF(t *testing.T) {
+	fmt.Println("Testing SAIP queue with earliest deadline first")
+	order := make([]string, 0)
+	RecordCommand := func(name []byte, data [][]byte) []byte {
+		order = append(order, string(name))
+		return nil
+	}
+	EDFSAIPQueue := NewSAIPQueueEDF(RecordCommand, 1)
+	misses := make([]DeadlineMiss, 0)
+	EDFSAIPQueue.SetDeadlineMissFunc(func(miss DeadlineMiss) {
+		misses = append(misses, miss)
+	})
+	now := time.Now()
+	EDFSAIPQueue.AddElement([]byte("later"), nil, now.Add(time.Hour))
+	EDFSAIPQueue.AddElement([]byte("late"), nil, now.Add(-time.Second))
+	EDFSAIPQueue.AddElement([]byte("soon"), nil, now.Add(time.Minute))
+	go EDFSAIPQueue.Run()
+	EDFSAIPQueue.Close()
+	EDFSAIPQueue.Wait()
+	if strings.Join(order, " ") != "late soon later" {
+		t.Error("Expected earliest deadline first, got:", order)
+	}
+	stats := EDFSAIPQueue.DeadlineStats()
+	if stats.Finished != 3 || stats.StartedLate != 1 || stats.FinishedLate != 1 {
+		t.Error("Unexpected deadline stats:", stats)
+	}
+	if len(misses) != 1 || string(misses[0].Name) != "late" || !misses[0].StartedLate() {
+		t.Error("Expected one deadline miss for late, got:", misses)
+	}
+}
+
+func TestSaipReserved(t *testing.T) {
+	fmt.Println("Testing SAIP queue with reserved slots")
+	release := make(chan struct{})
+	BlockCommand := func(name []byte, data [][]byte) []byte {
+		if string(name) != "high" {
+			<-release
+		}
+		return name
+	}
+	ReservedSAIPQueue := NewSAIPQueue(BlockCommand, 2)
+	ReservedSAIPQueue.SetReserved(1, 0)
+	go ReservedSAIPQueue.Run()
+	ReservedSAIPQueue.AddElement([]byte("low1"), nil, 5)
+	ReservedSAIPQueue.AddElement([]byte("low2"), nil, 5)
+	sr := ReservedSAIPQueue.AddElement([]byte("high"), nil, 0)
+	done := make(chan []byte)
+	go func() { done <- sr.Read() }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("High priority element was blocked by low priority elements")
+	}
+	if waiting, _ := ReservedSAIPQueue.NumElements(); waiting != 1 {
+		t.Error("Expected one low priority element to be waiting, got:", waiting)
+	}
+	close(release)
+	ReservedSAIPQueue.Close()
+	ReservedSAIPQueue.Wait()
+}
+
+func TestSaipReservedAll(t *testing.T) {
+	fmt.Println("Testing SAIP queue with all slots reserved")
+	ReservedSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	ReservedSAIPQueue.SetReserved(1, 0)
+	sr := ReservedSAIPQueue.AddElement([]byte("low"), nil, 5)
+	go ReservedSAIPQueue.Run()
+	done := make(chan []byte)
+	go func() { done <- sr.Read() }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Low priority element could not run with all slots reserved")
+	}
+	ReservedSAIPQueue.Close()
+	ReservedSAIPQueue.Wait()
+}
+
+func TestSaipPreemption(t *testing.T) {
+	fmt.Println("Testing SAIP queue with preemption")
+	lock := new(sync.Mutex)
+	runs := make([]string, 0)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	PreemptCommand := func(ctx context.Context, name []byte, data [][]byte) []byte {
+		lock.Lock()
+		runs = append(runs, string(name))
+		lock.Unlock()
+		if string(name) == "low" {
+			started <- struct{}{}
+			select {
+			case <-ctx.Done():
+				return []byte("preempted")
+			case <-release:
+			}
+		}
+		return bytes.Join(append([][]byte{name}, data...), []byte{' '})
+	}
+	PreemptSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	PreemptSAIPQueue.SetContextFunction(PreemptCommand)
+	PreemptSAIPQueue.SetPreemption(func(waiting, running int) bool { return running-waiting >= 2 })
+	go PreemptSAIPQueue.Run()
+	low := PreemptSAIPQueue.AddElement([]byte("low"), []byte("a"), 5)
+	<-started
+	PreemptSAIPQueue.AddElement([]byte("mid"), []byte("b"), 4)
+	high := PreemptSAIPQueue.AddElement([]byte("high"), []byte("c"), 0)
+	if r := high.Read(); string(r) != "high c" {
+		t.Error("Unexpected result of high priority element:", r)
+	}
+	close(release)
+	if r := low.Read(); string(r) != "low a" {
+		t.Error("Expected preempted element to be rerun, got:", r)
+	}
+	PreemptSAIPQueue.Close()
+	PreemptSAIPQueue.Wait()
+	if strings.Join(runs, " ") != "low high mid low" {
+		t.Error("Unexpected order of execution:", runs)
+	}
+}
+
+func TestSaipPreemptionLimit(t *testing.T) {
+	fmt.Println("Testing SAIP queue preemption within the limit")
+	lock := new(sync.Mutex)
+	running, maxRunning := 0, 0
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	// The handler ignores its context, so the preempted element runs until released
+	IgnoreCommand := func(name []byte, data [][]byte) []byte {
+		lock.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		lock.Unlock()
+		if string(name) == "low" {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return name
+	}
+	PreemptSAIPQueue := NewSAIPQueue(IgnoreCommand, 1)
+	PreemptSAIPQueue.SetPreemption(func(waiting, running int) bool { return waiting < running })
+	go PreemptSAIPQueue.Run()
+	low := PreemptSAIPQueue.AddElement([]byte("low"), nil, 5)
+	<-started
+	high := PreemptSAIPQueue.AddElementResult(context.Background(), []byte("high"), nil, 0)
+	select {
+	case <-high.Done():
+		t.Error("Expected high priority element to wait for the preempted handler to return")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if r := high.Read(); string(r) != "high" {
+		t.Error("Unexpected result of high priority element:", r)
+	}
+	if r := low.Read(); string(r) != "low" {
+		t.Error("Expected preempted element to be rerun, got:", r)
+	}
+	PreemptSAIPQueue.Close()
+	PreemptSAIPQueue.Wait()
+	if maxRunning != 1 {
+		t.Error("Expected at most 1 element running at once, got:", maxRunning)
+	}
+}
+
+func TestSaipPreemptedData(t *testing.T) {
+	fmt.Println("Testing SAIP queue data of preempted elements")
+	started := make(chan struct{})
+	hold := make(chan struct{})
+	seen := make(chan string, 1)
+	first := true
+	DataSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	DataSAIPQueue.SetContextFunction(func(ctx context.Context, name []byte, data [][]byte) []byte {
+		if string(name) == "low" && first {
+			first = false
+			started <- struct{}{}
+			<-ctx.Done()
+			started <- struct{}{}
+			// Still reading the data after being preempted
+			<-hold
+			seen <- string(bytes.Join(data, []byte(" ")))
+		}
+		return name
+	})
+	DataSAIPQueue.SetPreemption(func(waiting, running int) bool { return running-waiting >= 2 })
+	a := DataSAIPQueue.AddElementResult(context.Background(), []byte("low"), []byte("a"), 5)
+	DataSAIPQueue.AddElement([]byte("low"), []byte("b"), 5)
+	go DataSAIPQueue.Run()
+	<-started
+	DataSAIPQueue.AddElement([]byte("high"), []byte("c"), 0)
+	<-started
+	// Change the data of the requeued element
+	a.Withdraw()
+	DataSAIPQueue.AddElement([]byte("low"), []byte("d"), 5)
+	close(hold)
+	if s := <-seen; s != "a b" {
+		t.Error("Expected the data of the preempted handler to be unchanged, got:", s)
+	}
+	DataSAIPQueue.Close()
+	DataSAIPQueue.Wait()
+}
+
+func TestSaiChan(t *testing.T) {
+	fmt.Println("Testing SAI queue SafeReturn channel")
+	ChanSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	c := ChanSAIQueue.AddElement([]byte("1"), []byte("a"))
+	go ChanSAIQueue.Run()
+	select {
+	case r := <-c:
+		if string(r) != "1 a Finished!" {
+			t.Error("Unexpected result:", r)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the result on the channel")
+	}
+	ChanSAIQueue.Close()
+	ChanSAIQueue.Wait()
+}
+
+func TestSaipCapacity(t *testing.T) {
+	fmt.Println("Testing SAIP queue capacity")
+	CapacitySAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	CapacitySAIPQueue.SetCapacity(2, EvictWhenFull)
+	CapacitySAIPQueue.AddElement([]byte("a"), nil, 1)
+	b := CapacitySAIPQueue.AddElementResult(context.Background(), []byte("b"), nil, 5)
+	CapacitySAIPQueue.AddElement([]byte("c"), nil, 3)
+	if _, err := b.Result(); !errors.Is(err, ErrEvicted) {
+		t.Error("Expected lowest priority element to be evicted, got:", err)
+	}
+	if _, err := CapacitySAIPQueue.AddElementContext(context.Background(), []byte("d"), nil, 9); !errors.Is(err, ErrQueueFull) {
+		t.Error("Expected new lowest priority element to be rejected, got:", err)
+	}
+	CapacitySAIPQueue.SetCapacity(2, RejectWhenFull)
+	if _, err := CapacitySAIPQueue.AddElementResult(context.Background(), []byte("e"), nil, 0).Result(); !errors.Is(err, ErrQueueFull) {
+		t.Error("Expected element to be rejected, got:", err)
+	}
+	CapacitySAIPQueue.AddElement([]byte("a"), []byte("b"), 0)
+	if waiting, _ := CapacitySAIPQueue.NumElements(); waiting != 2 {
+		t.Error("Expected 2 waiting elements, got:", waiting)
+	}
+	go CapacitySAIPQueue.Run()
+	CapacitySAIPQueue.Close()
+	CapacitySAIPQueue.Wait()
+}
+
+func TestSaiCapacity(t *testing.T) {
+	fmt.Println("Testing SAI queue capacity")
+	CapacitySAIQueue := NewSAIQueue(ExampleCommand, 1)
+	CapacitySAIQueue.SetCapacity(1, BlockWhenFull)
+	CapacitySAIQueue.AddElement([]byte("1"), []byte("a"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := CapacitySAIQueue.AddElementContext(ctx, []byte("2"), []byte("a")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected adding to a full queue to time out, got:", err)
+	}
+	go CapacitySAIQueue.Run()
+	sr, err := CapacitySAIQueue.AddElementContext(context.Background(), []byte("2"), []byte("a"))
+	if err != nil {
+		t.Error("Expected element to be added once there is space, got:", err)
+	} else if r := sr.Read(); string(r) != "2 a Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	CapacitySAIQueue.Close()
+	CapacitySAIQueue.Wait()
+}
+
+func TestSaipMemoryBudget(t *testing.T) {
+	fmt.Println("Testing SAIP queue memory budget")
+	BudgetSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	BudgetSAIPQueue.SetMemoryBudget(10, 6, RejectWhenFull)
+	BudgetSAIPQueue.AddElement([]byte("a"), []byte("abcd"), 1)
+	if _, err := BudgetSAIPQueue.AddElementResult(context.Background(), []byte("a"), []byte("abc"), 1).Result(); !errors.Is(err, ErrOverBudget) {
+		t.Error("Expected data over the element budget to be rejected, got:", err)
+	}
+	BudgetSAIPQueue.AddElement([]byte("b"), []byte("abcdef"), 2)
+	if _, err := BudgetSAIPQueue.AddElementContext(context.Background(), []byte("c"), []byte("a"), 0); !errors.Is(err, ErrOverBudget) {
+		t.Error("Expected data over the queue budget to be rejected, got:", err)
+	}
+	if waiting, executing := BudgetSAIPQueue.NumBytes(); waiting != 10 || executing != 0 {
+		t.Error("Expected 10 waiting bytes and 0 executing, got:", waiting, executing)
+	}
+	go BudgetSAIPQueue.Run()
+	BudgetSAIPQueue.Close()
+	BudgetSAIPQueue.Wait()
+	if waiting, executing := BudgetSAIPQueue.NumBytes(); waiting != 0 || executing != 0 {
+		t.Error("Expected no bytes held, got:", waiting, executing)
+	}
+}
+
+func TestSaiMemoryBudget(t *testing.T) {
+	fmt.Println("Testing SAI queue memory budget")
+	BudgetSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	BudgetSAIQueue.SetMemoryBudget(4, 0, BlockWhenFull)
+	BudgetSAIQueue.AddElement([]byte("1"), []byte("ab"), []byte("cd"))
+	if _, err := BudgetSAIQueue.AddElementContext(context.Background(), []byte("2"), []byte("abcde")); !errors.Is(err, ErrOverBudget) {
+		t.Error("Expected data which can never fit to be rejected, got:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := BudgetSAIQueue.AddElementContext(ctx, []byte("2"), []byte("a")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected adding over the budget to time out, got:", err)
+	}
+	go BudgetSAIQueue.Run()
+	sr, err := BudgetSAIQueue.AddElementContext(context.Background(), []byte("2"), []byte("abcd"))
+	if err != nil {
+		t.Error("Expected element to be added once there is space, got:", err)
+	} else if r := sr.Read(); string(r) != "2 abcd Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	BudgetSAIQueue.Close()
+	BudgetSAIQueue.Wait()
+	// Each chunk is charged against the element budget separately
+	ChunkSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	ChunkSAIQueue.SetMaxDataPerElement(2)
+	ChunkSAIQueue.SetMemoryBudget(0, 4, RejectWhenFull)
+	ChunkSAIQueue.AddElement([]byte("a"), []byte("ab"))
+	if _, err := ChunkSAIQueue.TryAddElement([]byte("a"), []byte("cd"), []byte("ef"), []byte("gh")); err != nil {
+		t.Error("Expected data spilling into follow-on chunks to fit, got:", err)
+	}
+	if _, err := ChunkSAIQueue.TryAddElement([]byte("a"), []byte("i")); err != nil {
+		t.Error("Expected data starting a new chunk to fit, got:", err)
+	}
+	if _, err := ChunkSAIQueue.TryAddElement([]byte("a"), []byte("jklm")); !errors.Is(err, ErrOverBudget) {
+		t.Error("Expected data over the chunk budget to be rejected, got:", err)
+	}
+}
+
+func TestSaipTryAddElement(t *testing.T) {
+	fmt.Println("Testing SAIP queue TryAddElement")
+	TrySAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	TrySAIPQueue.SetCapacity(1, BlockWhenFull)
+	if _, err := TrySAIPQueue.TryAddElement([]byte("a"), []byte("a"), 1); err != nil {
+		t.Error("Expected element to be added, got:", err)
+	}
+	if _, err := TrySAIPQueue.TryAddElement([]byte("b"), []byte("a"), 1); !errors.Is(err, ErrFull) {
+		t.Error("Expected adding to a full queue to fail without blocking, got:", err)
+	}
+	// Blocks until the queue is closed
+	blocked := make(chan error)
+	go func() {
+		_, err := TrySAIPQueue.AddElementContext(context.Background(), []byte("c"), []byte("a"), 1)
+		blocked <- err
+	}()
+	TrySAIPQueue.Stop()
+	if _, err := TrySAIPQueue.TryAddElement([]byte("a"), []byte("b"), 1); !errors.Is(err, ErrStopped) {
+		t.Error("Expected adding to a stopped queue to fail, got:", err)
+	}
+	TrySAIPQueue.Close()
+	if err := <-blocked; !errors.Is(err, ErrClosed) {
+		t.Error("Expected blocked add to fail once closed, got:", err)
+	}
+	if _, err := TrySAIPQueue.TryAddElement([]byte("a"), []byte("b"), 1); !errors.Is(err, ErrClosed) {
+		t.Error("Expected adding to a closed queue to fail, got:", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected AddElement to panic on a closed queue")
+			}
+		}()
+		TrySAIPQueue.AddElement([]byte("a"), []byte("b"), 1)
+	}()
+	go TrySAIPQueue.Run()
+	TrySAIPQueue.Wait()
+}
+
+func TestSaiTryAddElement(t *testing.T) {
+	fmt.Println("Testing SAI queue TryAddElement while closing")
+	TrySAIQueue := NewSAIQueue(ExampleCommand, 2)
+	go TrySAIQueue.Run()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sr, err := TrySAIQueue.TryAddElement([]byte(strconv.Itoa(i)), nil)
+			if errors.Is(err, ErrClosed) {
+				if r := sr.Read(); r != nil {
+					t.Error("Expected the SafeReturn to hold an empty result, got:", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Error("Unexpected error:", err)
+			} else if r := sr.Read(); string(r) != strconv.Itoa(i)+"  Finished!" {
+				t.Error("Unexpected result:", r)
+			}
+		}(i)
+	}
+	TrySAIQueue.Close()
+	wg.Wait()
+	TrySAIQueue.Wait()
+}
+
+func TestSapipShutdown(t *testing.T) {
+	fmt.Println("Testing SAPIP queue shutdown")
+	ShutdownSAPIPQueue := NewSAPIPQueue(ExampleCommand, 1)
+	results := make([]Handle, 10)
+	for i := range results {
+		results[i] = ShutdownSAPIPQueue.AddElementResult(context.Background(), []byte(strconv.Itoa(i)), nil, i)
+	}
+	go ShutdownSAPIPQueue.Run(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+	defer cancel()
+	report := ShutdownSAPIPQueue.Shutdown(ctx)
+	if len(report.Completed) == 0 || len(report.Canceled) == 0 {
+		t.Error("Expected some elements to be completed and some canceled, got:", report)
+	}
+	if n := len(report.Completed) + len(report.Canceled) + len(report.Running); n != len(results) {
+		t.Error("Expected every element in the report, got:", report)
+	}
+	for _, name := range report.Canceled {
+		i, _ := strconv.Atoi(string(name))
+		if _, err := results[i].Result(); !errors.Is(err, ErrShutdown) {
+			t.Error("Expected canceled element to fail with ErrShutdown, got:", err)
+		}
+	}
+	if _, err := ShutdownSAPIPQueue.TryAddElement([]byte("a"), nil, 0); !errors.Is(err, ErrClosed) {
+		t.Error("Expected shut down queue to be closed, got:", err)
+	}
+	ShutdownSAPIPQueue.Stop()
+	ShutdownSAPIPQueue.Wait()
+}
+
+func TestSaiShutdown(t *testing.T) {
+	fmt.Println("Testing SAI queue shutdown")
+	ShutdownSAIQueue := NewSAIQueue(ExampleCommand, 2)
+	for i := 0; i < 10; i++ {
+		ShutdownSAIQueue.AddElement(Uint32ToByteArray(uint32(i)), nil)
+	}
+	go ShutdownSAIQueue.Run()
+	report := ShutdownSAIQueue.Shutdown(context.Background())
+	if len(report.Completed) != 10 || len(report.Canceled) != 0 || len(report.Running) != 0 {
+		t.Error("Expected every element to be completed, got:", report)
+	}
+	// Waiting on a stopped queue returns even though elements remain
+	StoppedSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	StoppedSAIQueue.AddElement([]byte("a"), nil)
+	StoppedSAIQueue.Stop()
+	StoppedSAIQueue.Close()
+	StoppedSAIQueue.Wait()
+}
+
+func waitForState(Q interface {
+	WatchState() (State, <-chan struct{})
+}, state State) bool {
+	timeout := time.After(time.Second)
+	for {
+		s, changed := Q.WatchState()
+		if s == state {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestSaiLifecycle(t *testing.T) {
+	fmt.Println("Testing SAI queue lifecycle")
+	release := make(chan struct{})
+	BlockingCommand := func(name []byte, data [][]byte) []byte {
+		<-release
+		return name
+	}
+	LifecycleSAIQueue := NewSAIQueue(BlockingCommand, 1)
+	if s := LifecycleSAIQueue.State(); s != StateNew {
+		t.Error("Expected new queue, got:", s)
+	}
+	go LifecycleSAIQueue.Run()
+	if !waitForState(LifecycleSAIQueue, StateRunning) {
+		t.Error("Expected queue to be running, got:", LifecycleSAIQueue.State())
+	}
+	// A second Run returns right away
+	LifecycleSAIQueue.Run()
+	sr := LifecycleSAIQueue.AddElement([]byte("a"), nil)
+	for _, executing := LifecycleSAIQueue.NumElements(); executing == 0; _, executing = LifecycleSAIQueue.NumElements() {
+		time.Sleep(time.Millisecond)
+	}
+	LifecycleSAIQueue.Stop()
+	if s := LifecycleSAIQueue.State(); s != StateStopping {
+		t.Error("Expected queue to be stopping, got:", s)
+	}
+	close(release)
+	if !waitForState(LifecycleSAIQueue, StateStopped) {
+		t.Error("Expected queue to be stopped, got:", LifecycleSAIQueue.State())
+	}
+	if r := sr.Read(); string(r) != "a" {
+		t.Error("Unexpected result:", r)
+	}
+	go LifecycleSAIQueue.Run()
+	if !waitForState(LifecycleSAIQueue, StateRunning) {
+		t.Error("Expected queue to be running again, got:", LifecycleSAIQueue.State())
+	}
+	LifecycleSAIQueue.Close()
+	if s := LifecycleSAIQueue.State(); s != StateClosed {
+		t.Error("Expected queue to be closed, got:", s)
+	}
+	LifecycleSAIQueue.Run()
+}
+
+func TestSapipRestart(t *testing.T) {
+	fmt.Println("Testing SAPIP queue restarts")
+	RestartSAPIPQueue := NewSAPIPQueue(ExampleCommand, 1)
+	for i := 0; i < 10; i++ {
+		go RestartSAPIPQueue.Run(time.Millisecond)
+		waitForState(RestartSAPIPQueue, StateRunning)
+		RestartSAPIPQueue.Stop()
+		if !waitForState(RestartSAPIPQueue, StateStopped) {
+			t.Error("Expected queue to be stopped, got:", RestartSAPIPQueue.State())
+		}
+	}
+	go RestartSAPIPQueue.Run(time.Millisecond)
+	if r := RestartSAPIPQueue.AddElement([]byte("a"), nil, 0).Read(); string(r) != "a  Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	RestartSAPIPQueue.Close()
+	RestartSAPIPQueue.Wait()
+}
+
+func TestSapiPause(t *testing.T) {
+	fmt.Println("Testing SAPI queue pause")
+	PauseSAPIQueue := NewSAPIQueue(ExampleCommand, 1)
+	go PauseSAPIQueue.Run(5 * time.Millisecond)
+	waitForState(PauseSAPIQueue, StateRunning)
+	PauseSAPIQueue.Pause()
+	if s := PauseSAPIQueue.State(); s != StatePaused {
+		t.Error("Expected queue to be paused, got:", s)
+	}
+	a := PauseSAPIQueue.AddElement([]byte("a"), []byte("1"))
+	PauseSAPIQueue.AddElement([]byte("b"), []byte("1"))
+	PauseSAPIQueue.AddElement([]byte("a"), []byte("2"))
+	time.Sleep(30 * time.Millisecond)
+	if waiting, executing := PauseSAPIQueue.NumElements(); waiting != 2 || executing != 0 {
+		t.Error("Expected 2 waiting elements and 0 executing while paused, got:", waiting, executing)
+	}
+	PauseSAPIQueue.Resume()
+	if r := a.Read(); string(r) != "a 1 2 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	PauseSAPIQueue.Close()
+	PauseSAPIQueue.Wait()
+}
+
+func TestSapipBatch(t *testing.T) {
+	fmt.Println("Testing SAPIP queue batches")
+	var batches []string
+	BatchCommand := func(names [][]byte, data [][][]byte) [][]byte {
+		batches = append(batches, string(bytes.Join(names, []byte(" "))))
+		results := make([][]byte, len(names))
+		for i, name := range names {
+			results[i] = append(append(name, ':'), bytes.Join(data[i], []byte(","))...)
+		}
+		return results
+	}
+	BatchSAPIPQueue := NewSAPIPQueue(ExampleCommand, 1)
+	BatchSAPIPQueue.SetBatchFunction(BatchCommand, 3)
+	results := make([]SafeReturn, 5)
+	for i := range results {
+		results[i] = BatchSAPIPQueue.AddElement([]byte(strconv.Itoa(i)), []byte("a"), 4-i)
+	}
+	BatchSAPIPQueue.AddElement([]byte("1"), []byte("b"), 0)
+	go BatchSAPIPQueue.Run(10 * time.Millisecond)
+	for i, sr := range results {
+		expected := strconv.Itoa(i) + ":a"
+		if i == 1 {
+			expected += ",b"
+		}
+		if r := sr.Read(); string(r) != expected {
+			t.Error("Unexpected result:", string(r), "expected:", expected)
+		}
+	}
+	BatchSAPIPQueue.Close()
+	BatchSAPIPQueue.Wait()
+	if fmt.Sprint(batches) != "[4 1 3 2 0]" {
+		t.Error("Unexpected batches:", batches)
+	}
+}
+
+func TestSaiBatchShortResults(t *testing.T) {
+	fmt.Println("Testing SAI queue batches with too few results")
+	ShortCommand := func(names [][]byte, data [][][]byte) [][]byte {
+		return names[:1]
+	}
+	BatchSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	BatchSAIQueue.SetBatchFunction(ShortCommand, 3)
+	results := make([]Handle, 3)
+	for i := range results {
+		results[i] = BatchSAIQueue.AddElementResult(context.Background(), []byte(strconv.Itoa(i)), []byte("a"))
+	}
+	go BatchSAIQueue.Run()
+	if r, err := results[0].Result(); err != nil || string(r) != "0" {
+		t.Error("Unexpected result:", r, err)
+	}
+	for _, sr := range results[1:] {
+		if _, err := sr.Result(); err != ErrNoResult {
+			t.Error("Expected element without a result to fail with ErrNoResult, got:", err)
+		}
+	}
+	BatchSAIQueue.Close()
+	BatchSAIQueue.Wait()
+}
+
+func TestSaiLinger(t *testing.T) {
+	fmt.Println("Testing SAI queue linger")
+	LingerSAIQueue := NewSAIQueue(ExampleCommand, 3)
+	LingerSAIQueue.SetLingerFunc(func(name []byte) Linger {
+		switch string(name) {
+		case "quiet":
+			return Linger{Quiet: 30 * time.Millisecond}
+		case "wait":
+			return Linger{Quiet: time.Hour, MaxWait: 30 * time.Millisecond}
+		}
+		return Linger{Quiet: time.Hour, MaxData: 2}
+	})
+	go LingerSAIQueue.Run()
+	quiet := LingerSAIQueue.AddElement([]byte("quiet"), []byte("1"))
+	wait := LingerSAIQueue.AddElement([]byte("wait"), []byte("1"))
+	data := LingerSAIQueue.AddElement([]byte("data"), []byte("1"))
+	time.Sleep(10 * time.Millisecond)
+	LingerSAIQueue.AddElement([]byte("quiet"), []byte("2"))
+	LingerSAIQueue.AddElement([]byte("wait"), []byte("2"))
+	LingerSAIQueue.AddElement([]byte("data"), []byte("2"))
+	if r := quiet.Read(); string(r) != "quiet 1 2 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := wait.Read(); string(r) != "wait 1 2 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := data.Read(); string(r) != "data 1 2 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	LingerSAIQueue.Close()
+	LingerSAIQueue.Wait()
+	// Stopping the queue stops the linger timer
+	StopSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	StopSAIQueue.SetLinger(Linger{Quiet: time.Hour})
+	go StopSAIQueue.Run()
+	StopSAIQueue.AddElement([]byte("a"), []byte("1"))
+	timer := func() *time.Timer {
+		StopSAIQueue.lock.Lock()
+		defer StopSAIQueue.lock.Unlock()
+		return StopSAIQueue.lingerTimer
+	}
+	for timer() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	StopSAIQueue.Stop()
+	StopSAIQueue.Wait()
+	if timer().Stop() {
+		t.Error("Expected the linger timer to be stopped with the queue")
+	}
+}
+
+func TestSaipMaxDataPerElement(t *testing.T) {
+	fmt.Println("Testing SAIP queue maximum data per element")
+	var order []string
+	OrderCommand := func(name []byte, data [][]byte) []byte {
+		order = append(order, string(name)+string(bytes.Join(data, nil)))
+		return ExampleCommand(name, data)
+	}
+	ChunkSAIPQueue := NewSAIPQueue(OrderCommand, 1)
+	ChunkSAIPQueue.SetMaxDataPerElement(2)
+	a1 := ChunkSAIPQueue.AddElement([]byte("a"), []byte("1"), 1)
+	a2 := ChunkSAIPQueue.AddElement([]byte("a"), []byte("2"), 1)
+	a3 := ChunkSAIPQueue.AddElement([]byte("a"), []byte("3"), 1)
+	ChunkSAIPQueue.AddElement([]byte("b"), []byte("1"), 1)
+	a4 := ChunkSAIPQueue.AddElement([]byte("a"), []byte("4"), 0)
+	if waiting, _ := ChunkSAIPQueue.NumElements(); waiting != 2 {
+		t.Error("Expected 2 waiting elements, got:", waiting)
+	}
+	go ChunkSAIPQueue.Run()
+	for _, sr := range []SafeReturn{a1, a2} {
+		if r := sr.Read(); string(r) != "a 1 2 Finished!" {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	for _, sr := range []SafeReturn{a3, a4} {
+		if r := sr.Read(); string(r) != "a 3 4 Finished!" {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	ChunkSAIPQueue.Close()
+	ChunkSAIPQueue.Wait()
+	if fmt.Sprint(order) != "[a12 a34 b1]" {
+		t.Error("Unexpected order:", order)
+	}
+	ChunkSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	ChunkSAIQueue.SetMaxDataPerElement(2)
+	b := ChunkSAIQueue.AddElement([]byte("b"), []byte("1"), []byte("2"), []byte("3"))
+	go ChunkSAIQueue.Run()
+	if r := b.Read(); string(r) != "b 3 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	ChunkSAIQueue.Close()
+	ChunkSAIQueue.Wait()
+	// A follow-on chunk takes the place of its element when that is withdrawn
+	WithdrawSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	WithdrawSAIQueue.SetMaxDataPerElement(1)
+	c1 := WithdrawSAIQueue.AddElementResult(context.Background(), []byte("c"), []byte("1"))
+	WithdrawSAIQueue.AddElement([]byte("c"), []byte("2"))
+	WithdrawSAIQueue.AddElement([]byte("d"), []byte("1"))
+	c1.Withdraw()
+	var names []string
+	for e := range WithdrawSAIQueue.All() {
+		names = append(names, string(e.Name)+string(bytes.Join(e.Data, nil)))
+	}
+	if fmt.Sprint(names) != "[c2 d1]" {
+		t.Error("Unexpected order:", names)
+	}
+}
+
+func TestSapipItemFunction(t *testing.T) {
+	fmt.Println("Testing SAPIP queue item function")
+	ItemCommand := func(name []byte, data [][]byte) [][]byte {
+		results := make([][]byte, len(data))
+		for i, d := range data {
+			results[i] = []byte(string(name) + ":" + string(d))
+		}
+		return results
+	}
+	ItemSAPIPQueue := NewSAPIPQueue(ExampleCommand, 1)
+	ItemSAPIPQueue.SetItemFunction(ItemCommand)
+	var srs []SafeReturn
+	for _, d := range []string{"1", "2", "3"} {
+		srs = append(srs, ItemSAPIPQueue.AddElement([]byte("a"), []byte(d), 0))
+	}
+	go ItemSAPIPQueue.Run(time.Millisecond)
+	for i, sr := range srs {
+		if r := sr.Read(); string(r) != "a:"+strconv.Itoa(i+1) {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	ItemSAPIPQueue.Close()
+	ItemSAPIPQueue.Wait()
+	ItemSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	ItemSAIQueue.SetItemFunction(ItemCommand)
+	b12 := ItemSAIQueue.AddElement([]byte("b"), []byte("1"), []byte("2"))
+	b3 := ItemSAIQueue.AddElement([]byte("b"), []byte("3"))
+	go ItemSAIQueue.Run()
+	if r := b12.Read(); string(r) != "b:2" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := b3.Read(); string(r) != "b:3" {
+		t.Error("Unexpected result:", r)
+	}
+	ItemSAIQueue.Close()
+	ItemSAIQueue.Wait()
+	ShortSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	ShortSAIPQueue.SetItemFunction(func(name []byte, data [][]byte) [][]byte { return data[:1] })
+	c1 := ShortSAIPQueue.AddElementResult(context.Background(), []byte("c"), []byte("1"), 0)
+	c2 := ShortSAIPQueue.AddElementResult(context.Background(), []byte("c"), []byte("2"), 0)
+	go ShortSAIPQueue.Run()
+	if r, err := c1.Result(); err != nil || string(r) != "1" {
+		t.Error("Unexpected result:", r, err)
+	}
+	if _, err := c2.Result(); err != ErrNoResult {
+		t.Error("Expected item without a result to fail with ErrNoResult, got:", err)
+	}
+	ShortSAIPQueue.Close()
+	ShortSAIPQueue.Wait()
+	// Items keep their own results once others are withdrawn
+	WithdrawSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	WithdrawSAIPQueue.SetItemFunction(ItemCommand)
+	d1 := WithdrawSAIPQueue.AddElementResult(context.Background(), []byte("d"), []byte("1"), 0)
+	d2 := WithdrawSAIPQueue.AddElementResult(context.Background(), []byte("d"), []byte("2"), 0)
+	d3 := WithdrawSAIPQueue.AddElement([]byte("d"), []byte("3"), 0)
+	d2.Withdraw()
+	go WithdrawSAIPQueue.Run()
+	if r := d1.Read(); string(r) != "d:1" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := d3.Read(); string(r) != "d:3" {
+		t.Error("Unexpected result:", r)
+	}
+	WithdrawSAIPQueue.Close()
+	WithdrawSAIPQueue.Wait()
+	// Without an item function, callers share the result of the element
+	SharedSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	e1 := SharedSAIPQueue.AddElement([]byte("e"), []byte("1"), 0)
+	if e2 := SharedSAIPQueue.AddElement([]byte("e"), []byte("2"), 0); e2 != e1 {
+		t.Error("Expected callers to share the channel of the element")
+	}
+	if n := len(SharedSAIPQueue.elements.NameIndex["e"].callers); n != 0 {
+		t.Error("Expected no callers to be recorded, got:", n)
+	}
+}
+
+func TestSapipWithdraw(t *testing.T) {
+	fmt.Println("Testing SAPIP queue withdrawing data")
+	WithdrawSAPIPQueue := NewSAPIPQueue(ExampleCommand, 1)
+	a1 := WithdrawSAPIPQueue.AddElementResult(context.Background(), []byte("a"), []byte("1"), 0)
+	a2 := WithdrawSAPIPQueue.AddElementResult(context.Background(), []byte("a"), []byte("2"), 0)
+	a3 := WithdrawSAPIPQueue.AddElementResult(context.Background(), []byte("a"), []byte("3"), 0)
+	b := WithdrawSAPIPQueue.AddElementResult(context.Background(), []byte("b"), []byte("1"), 0)
+	if !a2.Withdraw() || a2.Withdraw() {
+		t.Error("Expected a2 to be withdrawn once")
+	}
+	if _, err := a2.Result(); err != ErrWithdrawn {
+		t.Error("Expected ErrWithdrawn, got:", err)
+	}
+	if !b.Withdraw() {
+		t.Error("Expected b to be withdrawn")
+	}
+	if waiting, _ := WithdrawSAPIPQueue.NumElements(); waiting != 1 {
+		t.Error("Expected 1 waiting element, got:", waiting)
+	}
+	go WithdrawSAPIPQueue.Run(time.Millisecond)
+	for _, h := range []Handle{a1, a3} {
+		if r := h.Read(); string(r) != "a 1 3 Finished!" {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	if a1.Withdraw() {
+		t.Error("Expected finished a1 not to be withdrawn")
+	}
+	WithdrawSAPIPQueue.Close()
+	WithdrawSAPIPQueue.Wait()
+	WithdrawSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	c12 := WithdrawSAIQueue.AddElementResult(context.Background(), []byte("c"), []byte("1"), []byte("2"))
+	c3 := WithdrawSAIQueue.AddElement([]byte("c"), []byte("3"))
+	c12.Withdraw()
+	if waiting, _ := WithdrawSAIQueue.NumBytes(); waiting != 1 {
+		t.Error("Expected 1 waiting byte, got:", waiting)
+	}
+	go WithdrawSAIQueue.Run()
+	if r := c3.Read(); string(r) != "c 3 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	WithdrawSAIQueue.Close()
+	WithdrawSAIQueue.Wait()
+}
+
+func TestSaipDropAbandoned(t *testing.T) {
+	fmt.Println("Testing SAIP queue dropping abandoned elements")
+	AbandonSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	AbandonSAIPQueue.SetDropAbandoned(true)
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	a1 := AbandonSAIPQueue.AddElementResult(ctx1, []byte("a"), []byte("1"), 0)
+	a2 := AbandonSAIPQueue.AddElementResult(ctx2, []byte("a"), []byte("2"), 0)
+	cancel1()
+	time.Sleep(10 * time.Millisecond)
+	if waiting, _ := AbandonSAIPQueue.NumElements(); waiting != 1 {
+		t.Error("Expected 1 waiting element, got:", waiting)
+	}
+	cancel2()
+	for _, h := range []Handle{a1, a2} {
+		if _, err := h.Result(); err != ErrAbandoned {
+			t.Error("Expected ErrAbandoned, got:", err)
+		}
+	}
+	// A waiter on the result keeps the element
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	ctx4, cancel4 := context.WithCancel(context.Background())
+	b := AbandonSAIPQueue.AddElementResult(ctx3, []byte("b"), []byte("1"), 0)
+	go b.ResultContext(ctx4)
+	time.Sleep(10 * time.Millisecond)
+	cancel3()
+	time.Sleep(10 * time.Millisecond)
+	if waiting, _ := AbandonSAIPQueue.NumElements(); waiting != 1 {
+		t.Error("Expected 1 waiting element, got:", waiting)
+	}
+	cancel4()
+	if _, err := b.Result(); err != ErrAbandoned {
+		t.Error("Expected ErrAbandoned, got:", err)
+	}
+	// As does a caller of AddElement
+	ctx5, cancel5 := context.WithCancel(context.Background())
+	c1 := AbandonSAIPQueue.AddElement([]byte("c"), []byte("1"), 0)
+	c2, _ := AbandonSAIPQueue.AddElementContext(ctx5, []byte("c"), []byte("2"), 0)
+	cancel5()
+	time.Sleep(10 * time.Millisecond)
+	go AbandonSAIPQueue.Run()
+	for _, sr := range []SafeReturn{c1, c2} {
+		if r := sr.Read(); string(r) != "c 1 2 Finished!" {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	AbandonSAIPQueue.Close()
+	AbandonSAIPQueue.Wait()
+}
+
+func TestSaiDumpElements(t *testing.T) {
+	fmt.Println("Testing SAI queue dumping elements")
+	DumpSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	a := DumpSAIQueue.AddElementResult(context.Background(), []byte("a"), []byte("1"))
+	b := DumpSAIQueue.AddElementResult(context.Background(), []byte("b"), []byte("1"))
+	errs := make(chan error, 2)
+	for _, h := range []Handle{a, b} {
+		go func(h Handle) {
+			_, err := h.Result()
+			errs <- err
+		}(h)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if elements := DumpSAIQueue.DumpElements(); len(elements) != 2 {
+		t.Error("Expected 2 dumped elements, got:", len(elements))
+	}
+	for range 2 {
+		if err := <-errs; err != ErrDropped {
+			t.Error("Expected ErrDropped, got:", err)
+		}
+	}
+	for _, err := range []error{ErrEvicted, ErrShutdown, ErrWithdrawn, ErrAbandoned} {
+		if !errors.Is(err, ErrDropped) {
+			t.Error("Expected an ErrDropped, got:", err)
+		}
+	}
+}
+
+func TestSaiStopAndDump(t *testing.T) {
+	fmt.Println("Testing SAI queue stopping and dumping elements")
+	release := make(chan struct{})
+	StopSAIQueue := NewSAIQueue(func(name []byte, data [][]byte) []byte {
+		<-release
+		return []byte("done")
+	}, 1)
+	go StopSAIQueue.Run()
+	a := StopSAIQueue.AddElementResult(context.Background(), []byte("a"), []byte("1"))
+	time.Sleep(10 * time.Millisecond)
+	b := StopSAIQueue.AddElementResult(context.Background(), []byte("b"), []byte("1"))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := b.Result()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if elements := StopSAIQueue.StopAndDump(); len(elements) != 1 {
+		t.Error("Expected 1 dumped element, got:", len(elements))
+	}
+	if err := <-errs; err != ErrDropped {
+		t.Error("Expected ErrDropped, got:", err)
+	}
+	close(release)
+	if r, err := a.Result(); err != nil || string(r) != "done" {
+		t.Error("Expected the running element to finish, got:", r, err)
+	}
+}
+
+func TestSaipSnapshot(t *testing.T) {
+	fmt.Println("Testing SAIP queue snapshots")
+	release := make(chan struct{})
+	BlockCommand := func(name []byte, data [][]byte) []byte {
+		<-release
+		return name
+	}
+	names := func(elements []*PriorityElement) string {
+		var r []string
+		for _, e := range elements {
+			r = append(r, string(e.Name))
+		}
+		return strings.Join(r, " ")
+	}
+	SnapshotSAIPQueue := NewSAIPQueue(BlockCommand, 1)
+	SnapshotSAIPQueue.SetMaxDataPerElement(1)
+	x := SnapshotSAIPQueue.AddElement([]byte("x"), []byte("1"), 0)
+	go SnapshotSAIPQueue.Run()
+	for _, executing := SnapshotSAIPQueue.NumElements(); executing != 1; _, executing = SnapshotSAIPQueue.NumElements() {
+		time.Sleep(time.Millisecond)
+	}
+	SnapshotSAIPQueue.Pause()
+	a := SnapshotSAIPQueue.AddElementResult(context.Background(), []byte("a"), []byte("1"), 2)
+	SnapshotSAIPQueue.AddElement([]byte("b"), []byte("1"), 1)
+	SnapshotSAIPQueue.AddElement([]byte("b"), []byte("2"), 1)
+	SnapshotSAIPQueue.AddElement([]byte("c"), []byte("1"), 1)
+	SnapshotSAIPQueue.AddElement([]byte("d"), []byte("1"), 0)
+	waiting, executing := SnapshotSAIPQueue.Snapshot()
+	if names(waiting) != "d b b c a" {
+		t.Error("Unexpected waiting elements:", names(waiting))
+	}
+	if names(executing) != "x" {
+		t.Error("Unexpected executing elements:", names(executing))
+	}
+	if waiting, _ := SnapshotSAIPQueue.NumElements(); waiting != 4 {
+		t.Error("Expected 4 waiting elements, got:", waiting)
+	}
+	if drained := SnapshotSAIPQueue.Drain(); names(drained) != "d b b c a" {
+		t.Error("Unexpected drained elements:", names(drained))
+	}
+	if _, err := a.Result(); err != ErrDropped {
+		t.Error("Expected ErrDropped, got:", err)
+	}
+	if waiting, _ := SnapshotSAIPQueue.NumElements(); waiting != 0 {
+		t.Error("Expected 0 waiting elements, got:", waiting)
+	}
+	close(release)
+	if r := x.Read(); string(r) != "x" {
+		t.Error("Unexpected result:", r)
+	}
+	SnapshotSAIPQueue.Close()
+	SnapshotSAIPQueue.Wait()
+}
+
+func TestSaiIterators(t *testing.T) {
+	fmt.Println("Testing SAI queue iterators")
+	IterSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	IterSAIQueue.SetMaxDataPerElement(1)
+	IterSAIQueue.AddElement([]byte("a"), []byte("1"), []byte("2"))
+	IterSAIQueue.AddElement([]byte("b"), []byte("1"))
+	IterSAIQueue.AddElement([]byte("c"), []byte("1"))
+	var waiting []string
+	for e := range IterSAIQueue.All() {
+		waiting = append(waiting, string(e.Name)+string(bytes.Join(e.Data, nil)))
+		if len(waiting) == 3 {
+			break
+		}
+	}
+	if fmt.Sprint(waiting) != "[a1 a2 b1]" {
+		t.Error("Unexpected waiting elements:", waiting)
+	}
+	done := make(chan []string)
+	go func() {
+		var completed []string
+		for name, r := range IterSAIQueue.Completed(context.Background()) {
+			completed = append(completed, string(name)+": "+string(r.Value))
+		}
+		done <- completed
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go IterSAIQueue.Run()
+	IterSAIQueue.Close()
+	IterSAIQueue.Wait()
+	if completed := <-done; fmt.Sprint(completed) != "[a: a 1 Finished! a: a 2 Finished! b: b 1 Finished! c: c 1 Finished!]" {
+		t.Error("Unexpected completed elements:", completed)
+	}
+	// With an item function, each add call yields its own result or error
+	ItemIterSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	ItemIterSAIQueue.SetErrorFunc(func(name []byte, err interface{}) {})
+	ItemIterSAIQueue.SetItemFunction(func(name []byte, data [][]byte) [][]byte {
+		if string(name) == "p" {
+			panic("failed")
+		}
+		return data[:1]
+	})
+	ItemIterSAIQueue.AddElement([]byte("a"), []byte("1"))
+	ItemIterSAIQueue.AddElement([]byte("a"), []byte("2"))
+	ItemIterSAIQueue.AddElement([]byte("p"), []byte("1"))
+	go func() {
+		var completed []string
+		for name, r := range ItemIterSAIQueue.Completed(context.Background()) {
+			completed = append(completed, fmt.Sprint(string(name), ": ", string(r.Value), " ", r.Err))
+		}
+		done <- completed
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go ItemIterSAIQueue.Run()
+	ItemIterSAIQueue.Close()
+	ItemIterSAIQueue.Wait()
+	if completed := <-done; fmt.Sprint(completed) != "[a: 1 <nil> a:  "+ErrNoResult.Error()+" p:  "+ErrPanicked.Error()+"]" {
+		t.Error("Unexpected completed elements:", completed)
+	}
+}
+
+func TestSaipReorder(t *testing.T) {
+	fmt.Println("Testing SAIP queue reordering")
+	ReorderSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	order := func() string {
+		waiting, _ := ReorderSAIPQueue.Snapshot()
+		var r []string
+		for _, e := range waiting {
+			r = append(r, string(e.Name))
+		}
+		return strings.Join(r, " ")
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		ReorderSAIPQueue.AddElement([]byte(name), []byte("1"), 1)
+	}
+	ReorderSAIPQueue.AddElement([]byte("d"), []byte("1"), 0)
+	ReorderSAIPQueue.AddElement([]byte("e"), []byte("1"), 2)
+	ReorderSAIPQueue.MoveToFront([]byte("c"))
+	if order() != "d c a b e" {
+		t.Error("Unexpected order:", order())
+	}
+	ReorderSAIPQueue.MoveToBack([]byte("c"))
+	ReorderSAIPQueue.MoveBefore([]byte("e"), []byte("a"))
+	ReorderSAIPQueue.MoveToFront([]byte("b"))
+	if order() != "d b e a c" {
+		t.Error("Unexpected order:", order())
+	}
+	// New elements go at the end of their priority
+	ReorderSAIPQueue.AddElement([]byte("f"), []byte("1"), 1)
+	ReorderSAIPQueue.MoveBefore([]byte("a"), []byte("d"))
+	ReorderSAIPQueue.AddElement([]byte("g"), []byte("1"), 0)
+	if order() != "a d g b e c f" {
+		t.Error("Unexpected order:", order())
+	}
+	if ReorderSAIPQueue.MoveToFront([]byte("x")) || ReorderSAIPQueue.MoveBefore([]byte("a"), []byte("a")) {
+		t.Error("Expected invalid moves to fail")
+	}
+	// Follow-on chunks move to the new priority too
+	ChunkSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	ChunkSAIPQueue.SetMaxDataPerElement(1)
+	ChunkSAIPQueue.AddElement([]byte("i"), []byte("1"), 1)
+	ChunkSAIPQueue.AddElement([]byte("j"), []byte("1"), 2)
+	ChunkSAIPQueue.AddElement([]byte("h"), []byte("1"), 3)
+	ChunkSAIPQueue.AddElement([]byte("h"), []byte("2"), 3)
+	ChunkSAIPQueue.MoveBefore([]byte("h"), []byte("i"))
+	waiting, _ := ChunkSAIPQueue.Snapshot()
+	var chunkOrder []string
+	for _, e := range waiting {
+		chunkOrder = append(chunkOrder, string(e.Name)+":"+strconv.Itoa(e.Priority))
+	}
+	if fmt.Sprint(chunkOrder) != "[h:1 h:1 i:1 j:2]" {
+		t.Error("Unexpected order:", chunkOrder)
+	}
+	ReorderSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	for _, name := range []string{"a", "b", "c"} {
+		ReorderSAIQueue.AddElement([]byte(name), []byte("1"))
+	}
+	ReorderSAIQueue.MoveToFront([]byte("c"))
+	ReorderSAIQueue.MoveBefore([]byte("a"), []byte("c"))
+	ReorderSAIQueue.MoveToBack([]byte("a"))
+	ReorderSAIQueue.AddElement([]byte("d"), []byte("1"))
+	var names []string
+	for e := range ReorderSAIQueue.All() {
+		names = append(names, string(e.Name))
+	}
+	if fmt.Sprint(names) != "[c b a d]" {
+		t.Error("Unexpected order:", names)
+	}
+}
+
+func TestSapipMatching(t *testing.T) {
+	fmt.Println("Testing SAPIP queue bulk operations")
+	MatchSAPIPQueue := NewSAPIPQueue(ExampleCommand, 1)
+	sync1 := MatchSAPIPQueue.AddElementResult(context.Background(), []byte("customer:1:sync"), []byte("1"), 1)
+	mail1 := MatchSAPIPQueue.AddElementResult(context.Background(), []byte("customer:1:mail"), []byte("1"), 1)
+	MatchSAPIPQueue.AddElement([]byte("customer:2:sync"), []byte("1"), 1)
+	MatchSAPIPQueue.AddElement([]byte("other"), []byte("1"), 0)
+	if n := MatchSAPIPQueue.CountMatching(MatchPrefix([]byte("customer:1:"))); n != 2 {
+		t.Error("Expected 2 matching elements, got:", n)
+	}
+	if n := MatchSAPIPQueue.SetPriorityMatching(MatchPrefix([]byte("customer:2:")), 0); n != 1 {
+		t.Error("Expected 1 matching element, got:", n)
+	}
+	var names []string
+	for e := range MatchSAPIPQueue.All() {
+		names = append(names, string(e.Name))
+	}
+	if fmt.Sprint(names) != "[other customer:2:sync customer:1:sync customer:1:mail]" {
+		t.Error("Unexpected order:", names)
+	}
+	if n := MatchSAPIPQueue.CancelMatching(MatchPrefix([]byte("customer:1:"))); n != 2 {
+		t.Error("Expected 2 canceled elements, got:", n)
+	}
+	for _, h := range []Handle{sync1, mail1} {
+		if _, err := h.Result(); err != ErrCanceled {
+			t.Error("Expected ErrCanceled, got:", err)
+		}
+	}
+	isSync := func(name []byte) bool { return bytes.HasSuffix(name, []byte(":sync")) }
+	if n := MatchSAPIPQueue.CountMatching(isSync); n != 1 {
+		t.Error("Expected 1 matching element, got:", n)
+	}
+}
+
+func TestSaipMetadata(t *testing.T) {
+	fmt.Println("Testing SAIP queue metadata")
+	MetadataSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	MetadataSAIPQueue.SetJobFunction(func(ctx context.Context, jobs []*Job) [][]byte {
+		return [][]byte{[]byte(jobs[0].Metadata["tenant"] + " " + jobs[0].Metadata["trace"])}
+	}, 1)
+	a1 := MetadataSAIPQueue.AddElementWithMetadata([]byte("a"), []byte("1"), 0, map[string]string{"tenant": "t1", "trace": "x"})
+	a2, err := MetadataSAIPQueue.AddElementContextWithMetadata(context.Background(), []byte("a"), []byte("2"), 0, map[string]string{"trace": "y"})
+	if err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	a3, err := MetadataSAIPQueue.TryAddElementWithMetadata([]byte("a"), []byte("3"), 0, map[string]string{"region": "r"})
+	if err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	// Later values replace earlier ones
+	waiting, _ := MetadataSAIPQueue.Snapshot()
+	if fmt.Sprint(waiting[0].Metadata) != "map[region:r tenant:t1 trace:y]" {
+		t.Error("Unexpected metadata:", waiting[0].Metadata)
+	}
+	go MetadataSAIPQueue.Run()
+	for _, sr := range []SafeReturn{a1, a2, a3} {
+		if r := sr.Read(); string(r) != "t1 y" {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	MetadataSAIPQueue.Close()
+	MetadataSAIPQueue.Wait()
+	// A job can return the result of each data item
+	ItemSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	ItemSAIQueue.SetJobFunction(func(ctx context.Context, jobs []*Job) [][]byte {
+		for _, d := range jobs[0].Data {
+			jobs[0].Results = append(jobs[0].Results, []byte(jobs[0].Metadata["tenant"]+":"+string(d)))
+		}
+		return nil
+	}, 1)
+	b1 := ItemSAIQueue.AddElementWithMetadata([]byte("b"), map[string]string{"tenant": "t2"}, []byte("1"))
+	b2 := ItemSAIQueue.AddElement([]byte("b"), []byte("2"))
+	go ItemSAIQueue.Run()
+	if r := b1.Read(); string(r) != "t2:1" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := b2.Read(); string(r) != "t2:2" {
+		t.Error("Unexpected result:", r)
+	}
+	ItemSAIQueue.Close()
+	ItemSAIQueue.Wait()
+	// Batches are given the metadata of each element
+	BatchSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	BatchSAIQueue.SetJobFunction(func(ctx context.Context, jobs []*Job) [][]byte {
+		results := make([][]byte, len(jobs))
+		for i, job := range jobs {
+			results[i] = []byte(job.Metadata["tenant"])
+		}
+		return results
+	}, 2)
+	cs := BatchSAIQueue.AddElements([]Item{{Name: []byte("c"), Data: [][]byte{[]byte("1")}, Metadata: map[string]string{"tenant": "t3"}}, {Name: []byte("d"), Data: [][]byte{[]byte("1")}}})
+	go BatchSAIQueue.Run()
+	for i, expected := range []string{"t3", ""} {
+		if r := cs[i].Read(); string(r) != expected {
+			t.Error("Unexpected result:", r)
+		}
+	}
+	BatchSAIQueue.Close()
+	BatchSAIQueue.Wait()
+}
+
+func TestSaiAddElements(t *testing.T) {
+	fmt.Println("Testing SAI queue AddElements")
+	BatchSAIQueue := NewSAIQueue(ExampleCommand, 1)
+	BatchSAIQueue.SetCapacity(2, BlockWhenFull)
+	srs := BatchSAIQueue.AddElements([]Item{{[]byte("a"), [][]byte{[]byte("1")}, nil}, {[]byte("b"), [][]byte{[]byte("2")}, nil}, {[]byte("a"), [][]byte{[]byte("3")}, nil}, {[]byte("c"), [][]byte{[]byte("4")}, nil}})
+	if len(srs) != 4 {
+		t.Fatal("Expected 4 results, got:", len(srs))
+	}
+	select {
+	case r := <-srs[3]:
+		if r != nil {
+			t.Error("Unexpected result:", r)
+		}
+	default:
+		t.Error("Expected element to be rejected rather than block")
+	}
+	if waiting, _ := BatchSAIQueue.NumElements(); waiting != 2 {
+		t.Error("Expected 2 waiting elements, got:", waiting)
+	}
+	go BatchSAIQueue.Run()
+	if r := srs[0].Read(); string(r) != "a 1 3 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := srs[2].Read(); string(r) != "a 1 3 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	if r := srs[1].Read(); string(r) != "b 2 Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	BatchSAIQueue.Close()
+	BatchSAIQueue.Wait()
+}
+
+func TestSaipAddElements(t *testing.T) {
+	fmt.Println("Testing SAIP queue AddElements")
+	BatchSAIPQueue := NewSAIPQueue(ExampleCommand, 1)
+	BatchSAIPQueue.SetCapacity(2, EvictWhenFull)
+	srs := BatchSAIPQueue.AddElements([]PriorityItem{{[]byte("a"), nil, 1, nil}, {[]byte("b"), nil, 5, nil}, {[]byte("c"), nil, 3, nil}, {[]byte("d"), nil, 9, nil}})
+	for _, i := range []int{1, 3} {
+		select {
+		case <-srs[i]:
+		default:
+			t.Error("Expected lowest priority elements to be evicted or rejected:", i)
+		}
+	}
+	if waiting, _ := BatchSAIPQueue.Snapshot(); len(waiting) != 2 || string(waiting[0].Name) != "a" || string(waiting[1].Name) != "c" {
+		t.Error("Expected a and c to be waiting, got:", waiting)
+	}
+	go BatchSAIPQueue.Run()
+	if r := srs[2].Read(); string(r) != "c  Finished!" {
+		t.Error("Unexpected result:", r)
+	}
+	BatchSAIPQueue.Close()
+	BatchSAIPQueue.Wait()
+}
+
 func Uint32ToByteArray(i uint32) []byte {
 	counter := make([]byte, 4)
 	counter[0] = byte(i >> 24)
@@ -155,6 +1535,49 @@ func BenchmarkSaipAddElements(b *testing.B) {
 	wg.Wait()
 }
 
+func BenchmarkSaipAddElementsBatch(b *testing.B) {
+	wg := new(sync.WaitGroup)
+	DrainCommand := func(name []byte, data [][]byte) []byte {
+		wg.Done()
+		return nil
+	}
+	BenchSAIPQueue := NewSAIPQueue(DrainCommand, 1)
+	items := make([]PriorityItem, b.N)
+	for i := range items {
+		items[i] = PriorityItem{Uint32ToByteArray(uint32(i)), nil, 0, nil}
+	}
+	wg.Add(b.N)
+	b.ResetTimer()
+	BenchSAIPQueue.AddElements(items)
+	// Time only the adds, not draining the queue
+	b.StopTimer()
+	go BenchSAIPQueue.Run()
+	wg.Wait()
+}
+
+// As BenchmarkSaipAddElementsBatch, adding each element with AddElement
+func BenchmarkSaipAddElementsEach(b *testing.B) {
+	wg := new(sync.WaitGroup)
+	DrainCommand := func(name []byte, data [][]byte) []byte {
+		wg.Done()
+		return nil
+	}
+	BenchSAIPQueue := NewSAIPQueue(DrainCommand, 1)
+	items := make([]PriorityItem, b.N)
+	for i := range items {
+		items[i] = PriorityItem{Uint32ToByteArray(uint32(i)), nil, 0, nil}
+	}
+	wg.Add(b.N)
+	b.ResetTimer()
+	for _, item := range items {
+		BenchSAIPQueue.AddElement(item.Name, item.Data, item.Priority)
+	}
+	// Time only the adds, not draining the queue
+	b.StopTimer()
+	go BenchSAIPQueue.Run()
+	wg.Wait()
+}
+
 func BenchmarkSaipUpdatePriority(b *testing.B) {
 	wg := new(sync.WaitGroup)
 	DrainCommand := func(name []byte, data [][]byte) []byte {
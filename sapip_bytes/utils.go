@@ -18,38 +18,701 @@
 package sapip_bytes
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"log"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
 )
 
+var (
+	ErrClosed     = errors.New("queue is closed")
+	ErrStopped    = errors.New("queue is stopped")
+	ErrFull       = errors.New("queue is full")
+	ErrQueueFull  = ErrFull // Same as ErrFull
+	ErrOverBudget = errors.New("queue memory budget exceeded")
+	ErrDropped    = errors.New("element was dropped from the queue")
+	ErrNoResult   = errors.New("handler returned no result for the element")
+	ErrPanicked   = errors.New("handler panicked")
+	// Each of these is also an ErrDropped
+	ErrEvicted   error = droppedError("element was evicted from a full queue")
+	ErrShutdown  error = droppedError("element was canceled by the queue shutting down")
+	ErrWithdrawn error = droppedError("element data was withdrawn")
+	ErrAbandoned error = droppedError("element was abandoned by its waiters")
+	ErrCanceled  error = droppedError("element was canceled")
+)
+
+// An error of an element which was removed from the queue without executing
+type droppedError string
+
+func (err droppedError) Error() string        { return string(err) }
+func (err droppedError) Is(target error) bool { return target == ErrDropped }
+
 type SafeReturn chan []byte
 
 func (SR SafeReturn) Return(value []byte) { SR <- value }
 func (SR SafeReturn) Read() []byte        { value := <-SR; SR <- value; return value }
 
+// Return value unless one has already been returned, without blocking
+func (SR SafeReturn) send(value []byte) {
+	select {
+	case SR <- value:
+	default:
+	}
+}
+
+// Returns a SafeReturn which already holds an empty result, for data which
+// was not added
+func emptyReturn() SafeReturn { SR := make(SafeReturn, 1); SR <- nil; return SR }
+
+// A handle on the data added by one AddElementResult call, which receives
+// the result of the data or an error, such as ErrEvicted, and can withdraw the
+// data while it is waiting. It can be read by multiple threads.
+// The first value or error returned is kept, later ones are ignored.
+type Handle struct{ *result }
+
+type result struct {
+	lock     sync.Mutex
+	done     chan struct{} // Made once waited on, or closedChan if finished before then
+	finished bool
+	value    []byte
+	err      error
+	owner    withdrawer // Withdraws the data added with the handle, if set
+	name     []byte     // Name of the element the data was added to
+	watchers *watchers  // Waiters on the data added with the handle, if they are counted
+}
+
+// The waiters on the data added by one call, counted by a queue which drops
+// abandoned elements
+type watchers struct {
+	watch   func(ctx context.Context) // Counts a waiter until ctx is done
+	waiters int                       // Number of waiters
+	stops   []func() bool             // Stop watching the contexts of the waiters
+}
+
+// Stop watching the contexts of the waiters, once the data has a result
+func (w *watchers) stop() {
+	if w == nil {
+		return
+	}
+	for _, stop := range w.stops {
+		stop()
+	}
+}
+
+// Withdraws the data added with r from the waiting element of the name
+type withdrawer interface {
+	withdraw(Name []byte, r *result) bool
+}
+
+// Shared by the handles which finish before they are waited on
+var closedChan = make(chan struct{})
+
+func init() { close(closedChan) }
+
+func makeHandle() Handle { return Handle{new(result)} }
+
+// Waits for the element to finish, and returns its value, or nil on error
+func (H Handle) Read() []byte { value, _ := H.Result(); return value }
+
+// Waits for the element to finish, and returns its value and any error, such as ErrEvicted
+func (H Handle) Result() ([]byte, error) { <-H.Done(); return H.value, H.err }
+
+// Waits for the element to finish as with Result, or for ctx to be done,
+// returning ctx.Err(). With a queue which drops abandoned elements, the
+// caller counts as a waiter on the element until then.
+func (H Handle) ResultContext(ctx context.Context) ([]byte, error) {
+	if H.watchers != nil {
+		H.watchers.watch(ctx)
+	}
+	select {
+	case <-H.Done():
+		return H.value, H.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Closed once the element has finished
+func (H Handle) Done() <-chan struct{} {
+	H.lock.Lock()
+	defer H.lock.Unlock()
+	if H.done == nil {
+		H.done = make(chan struct{})
+	}
+	return H.done
+}
+
+// Withdraws the data added with this Handle from its element, if it is still
+// waiting, and fails it with ErrWithdrawn. The element is removed once it has
+// no data left. Returns whether the data was withdrawn.
+func (H Handle) Withdraw() bool {
+	if H.owner == nil {
+		return false
+	}
+	return H.owner.withdraw(H.name, H.result)
+}
+
+func (H Handle) resolve(value []byte, err error) {
+	H.lock.Lock()
+	if H.finished {
+		H.lock.Unlock()
+		return
+	}
+	H.finished = true
+	H.value = value
+	H.err = err
+	if H.done == nil {
+		H.done = closedChan
+	} else {
+		close(H.done)
+	}
+	H.lock.Unlock()
+	H.watchers.stop()
+}
+
+// The data items added to an element by one AddElement call which needs its
+// own result or waiters, and where its result goes. Other calls share the
+// OutChannel of the element, and are not recorded.
+type contribution struct {
+	out     SafeReturn // Receives the value, if the caller has its own channel
+	handle  *result    // Receives the value or error, if added with a Handle
+	waiters *watchers  // Waiters on the data, if they are counted
+	start   int        // Index in Data of the first data item added
+	items   int        // Number of data items added
+	partial bool       // Whether the rest of the data is in a later chunk, which returns the result
+}
+
+// Return the value, or fail with err, to the caller
+func (c contribution) resolve(value []byte, err error) {
+	c.out.send(value)
+	if c.handle != nil {
+		Handle{c.handle}.resolve(value, err)
+	}
+	c.waiters.stop()
+}
+
+// Return the caller the result of its last data item, or fail it with
+// ErrNoResult if there is none, and return that result
+func (c contribution) resolveItem(results [][]byte) Completion {
+	done := Completion{}
+	if i := c.start + c.items; c.items > 0 && i <= len(results) {
+		done.Value = results[i-1]
+	} else if c.items > 0 {
+		done.Err = ErrNoResult
+	}
+	c.resolve(done.Value, done.Err)
+	return done
+}
+
+// What to do when adding an element to a queue which is at capacity
+type FullPolicy int
+
+const (
+	BlockWhenFull  FullPolicy = iota // Block until there is space
+	RejectWhenFull                   // Fail the new element with ErrFull
+	EvictWhenFull                    // Evict the lowest priority (or without priorities, oldest) element, failing it with ErrEvicted
+)
+
 type Element struct {
 	Name       []byte
 	Data       [][]byte
+	Metadata   map[string]string // Metadata merged from all the data added to the element
 	OutChannel SafeReturn
 	Next       *Element
 	Prev       *Element
+	size       int            // Total size of the data in bytes
+	added      time.Time      // Time the element was first enqueued
+	updated    time.Time      // Time data was last added to the element
+	chunks     []*Element     // Follow-on elements of the same name, holding data beyond the maximum
+	callers    []contribution // The recorded AddElement calls which added data, in order
+	untracked  bool           // Whether data was added by calls which were not recorded
+}
+
+// The last follow-on chunk of the element, or the element itself
+func (e *Element) lastChunk() *Element {
+	if len(e.chunks) == 0 {
+		return e
+	}
+	return e.chunks[len(e.chunks)-1]
+}
+
+// A copy of the element, outside of any queue
+func (e *Element) copy() *Element {
+	return &Element{Name: e.Name, Data: append([][]byte(nil), e.Data...), Metadata: maps.Clone(e.Metadata), OutChannel: e.OutChannel, size: e.size, added: e.added, updated: e.updated}
+}
+
+// Return value to all waiting on the element
+func (e *Element) returnAll(value []byte) []Completion {
+	e.OutChannel.send(value)
+	for _, c := range e.callers {
+		if !c.partial {
+			c.resolve(value, nil)
+		}
+	}
+	return []Completion{{value, nil}}
+}
+
+// Return each caller the result of its data item, or of its last if it added
+// several. Callers whose item has no result fail with ErrNoResult. Returns
+// the result of each caller, and an empty one for any which were not recorded.
+func (e *Element) returnItems(results [][]byte) []Completion {
+	e.OutChannel.send(nil)
+	var done []Completion
+	if e.untracked {
+		done = append(done, Completion{})
+	}
+	for _, c := range e.callers {
+		if c.partial {
+			continue
+		}
+		done = append(done, c.resolveItem(results))
+	}
+	return done
+}
+
+// Return err to all waiting on the element
+func (e *Element) failAll(err error) []Completion {
+	e.OutChannel.send(nil)
+	for _, c := range e.callers {
+		if !c.partial {
+			c.resolve(nil, err)
+		}
+	}
+	return []Completion{{nil, err}}
 }
 
-type PriorityElement struct {
+// Whether all of the waiters on the element have gone
+func (e *Element) abandoned() bool {
+	if e.untracked {
+		return false
+	}
+	for _, c := range e.callers {
+		if c.waiters == nil || c.waiters.waiters > 0 {
+			return false
+		}
+	}
+	return len(e.callers) > 0
+}
+
+// Remove the data added with r, and return its size and whether there was any
+func (e *Element) withdraw(r *result) (int, bool) {
+	size := 0
+	removed := 0
+	callers := make([]contribution, 0, len(e.callers))
+	for _, c := range e.callers {
+		c.start -= removed
+		if c.handle != r {
+			callers = append(callers, c)
+			continue
+		}
+		size += dataSize(e.Data[c.start : c.start+c.items])
+		// Build new data, as an executing handler may still read the old
+		e.Data = append(e.Data[:c.start:c.start], e.Data[c.start+c.items:]...)
+		removed += c.items
+	}
+	found := len(callers) < len(e.callers)
+	e.callers = callers
+	e.size -= size
+	return size, found
+}
+
+type PriorityElementOf[P comparable] struct {
 	Name       []byte
 	Data       [][]byte
-	Priority   int
+	Metadata   map[string]string // Metadata merged from all the data added to the element
+	Priority   P
 	OutChannel SafeReturn
-	Next       *PriorityElement
-	Prev       *PriorityElement
+	Next       *PriorityElementOf[P]
+	Prev       *PriorityElementOf[P]
+	Added      time.Time               // Time the element was first enqueued
+	Newer      *PriorityElementOf[P]   // Next element in order of age
+	Older      *PriorityElementOf[P]   // Previous element in order of age
+	extra      []SafeReturn            // Returns of preempted elements merged into this one
+	cancel     context.CancelFunc      // Cancels the element while it is executing
+	preempted  bool                    // Whether the element was preempted while executing
+	finished   bool                    // Whether the element has finished executing, and can no longer be preempted
+	size       int                     // Total size of the data in bytes
+	deadline   time.Time               // Deadline of the executing element, if deadlines are tracked
+	updated    time.Time               // Time data was last added to the element
+	chunks     []*PriorityElementOf[P] // Follow-on elements of the same name, holding data beyond the maximum
+	callers    []contribution          // The recorded AddElement calls which added data, in order
+	untracked  bool                    // Whether data was added by calls which were not recorded
+}
+
+// The last follow-on chunk of the element, or the element itself
+func (e *PriorityElementOf[P]) lastChunk() *PriorityElementOf[P] {
+	if len(e.chunks) == 0 {
+		return e
+	}
+	return e.chunks[len(e.chunks)-1]
+}
+
+// A copy of the element, outside of any queue
+func (e *PriorityElementOf[P]) copy() *PriorityElementOf[P] {
+	return &PriorityElementOf[P]{Name: e.Name, Data: append([][]byte(nil), e.Data...), Metadata: maps.Clone(e.Metadata), Priority: e.Priority, OutChannel: e.OutChannel, Added: e.Added, size: e.size, updated: e.updated}
+}
+
+// Marks e and its follow-on chunks as seen, and returns copies of them
+func see[P comparable](e *PriorityElementOf[P], seen map[*PriorityElementOf[P]]bool) []*PriorityElementOf[P] {
+	seen[e] = true
+	elements := []*PriorityElementOf[P]{e.copy()}
+	for _, c := range e.chunks {
+		// Chunks are seen here, rather than once they are promoted
+		seen[c] = true
+		elements = append(elements, c.copy())
+	}
+	return elements
+}
+
+// Return value to all waiting on the element
+func (e *PriorityElementOf[P]) returnAll(value []byte) []Completion {
+	e.OutChannel.send(value)
+	for _, sr := range e.extra {
+		sr.send(value)
+	}
+	for _, c := range e.callers {
+		c.resolve(value, nil)
+	}
+	return []Completion{{value, nil}}
+}
+
+// Return each caller the result of its data item. Callers whose item has no
+// result fail with ErrNoResult. Returns the result of each caller, and an
+// empty one for any which were not recorded.
+func (e *PriorityElementOf[P]) returnItems(results [][]byte) []Completion {
+	e.OutChannel.send(nil)
+	for _, sr := range e.extra {
+		sr.send(nil)
+	}
+	var done []Completion
+	if e.untracked || len(e.extra) > 0 {
+		done = append(done, Completion{})
+	}
+	for _, c := range e.callers {
+		done = append(done, c.resolveItem(results))
+	}
+	return done
+}
+
+// Return err to all waiting on the element
+func (e *PriorityElementOf[P]) failAll(err error) []Completion {
+	e.OutChannel.send(nil)
+	for _, sr := range e.extra {
+		sr.send(nil)
+	}
+	for _, c := range e.callers {
+		c.resolve(nil, err)
+	}
+	return []Completion{{nil, err}}
 }
 
+// Whether all of the waiters on the element have gone
+func (e *PriorityElementOf[P]) abandoned() bool {
+	if e.untracked {
+		return false
+	}
+	for _, c := range e.callers {
+		if c.waiters == nil || c.waiters.waiters > 0 {
+			return false
+		}
+	}
+	return len(e.callers) > 0
+}
+
+// Remove the data added with r, and return its size and whether there was any
+func (e *PriorityElementOf[P]) withdraw(r *result) (int, bool) {
+	size := 0
+	removed := 0
+	callers := make([]contribution, 0, len(e.callers))
+	for _, c := range e.callers {
+		c.start -= removed
+		if c.handle != r {
+			callers = append(callers, c)
+			continue
+		}
+		size += dataSize(e.Data[c.start : c.start+c.items])
+		// Build new data, as an executing handler may still read the old
+		e.Data = append(e.Data[:c.start:c.start], e.Data[c.start+c.items:]...)
+		removed += c.items
+	}
+	found := len(callers) < len(e.callers)
+	e.callers = callers
+	e.size -= size
+	return size, found
+}
+
+// Record c as the contribution of the data item at index i, if it is not nil,
+// and return the channel which receives the result of the item
+func (e *PriorityElementOf[P]) record(c *contribution, i int) SafeReturn {
+	if c == nil {
+		e.untracked = true
+		return e.OutChannel
+	}
+	c.start, c.items = i, 1
+	e.callers = append(e.callers, *c)
+	if c.out == nil {
+		return e.OutChannel
+	}
+	return c.out
+}
+
+// Element of a queue with int priorities
+type PriorityElement = PriorityElementOf[int]
+
+// An element to add with AddElements
+type Item struct {
+	Name     []byte
+	Data     [][]byte
+	Metadata map[string]string // Merged into the metadata of the element, or nil
+}
+
+// An element to add with AddElements to a priority queue
+type PriorityItemOf[P comparable] struct {
+	Name     []byte
+	Data     []byte
+	Priority P
+	Metadata map[string]string // Merged into the metadata of the element, or nil
+}
+
+// Item of a queue with int priorities
+type PriorityItem = PriorityItemOf[int]
+
 type QueueFunction func(name []byte, data [][]byte) []byte
+
+// Handler function which is given a context, which is canceled
+// if the element is preempted
+type QueueContextFunction func(ctx context.Context, name []byte, data [][]byte) []byte
+
+// How long an element waits to collect more data before it can execute
+type Linger struct {
+	Quiet   time.Duration // Waits until no data has been added for this long
+	MaxWait time.Duration // Waits at most this long since first added, or 0 for no maximum
+	MaxData int           // Waits until it has this much data, or 0 for no maximum
+}
+
+// Handler function which executes a batch of elements, returning
+// the result of each element in the same order as names. Elements
+// without a result fail with ErrNoResult.
+type QueueBatchFunction func(names [][]byte, data [][][]byte) [][]byte
+
+// Handler function which returns the result of each data item
+// of an element, in the same order as data. Items without a result
+// fail with ErrNoResult.
+type QueueItemFunction func(name []byte, data [][]byte) [][]byte
+
+// An executing element, as given to a QueueJobFunction
+type Job struct {
+	Name     []byte
+	Data     [][]byte
+	Metadata map[string]string // Merged from all the data added to the element
+	Results  [][]byte          // Set by the handler to the result of each data item, in place of the result of the element
+}
+
+// Handler function which is given executing elements with their metadata,
+// returning the result of each in the same order as jobs. Jobs without a
+// result fail with ErrNoResult, unless the handler sets their Results.
+type QueueJobFunction func(ctx context.Context, jobs []*Job) [][]byte
+
+// Wrap f as a QueueContextFunction, ignoring the context
+func contextFunction(f QueueFunction) QueueContextFunction {
+	return func(ctx context.Context, name []byte, data [][]byte) []byte { return f(name, data) }
+}
+
+// Wrap f as a QueueJobFunction, which is given one job at a time
+func contextJobFunction(f QueueContextFunction) QueueJobFunction {
+	return func(ctx context.Context, jobs []*Job) [][]byte {
+		return [][]byte{f(ctx, jobs[0].Name, jobs[0].Data)}
+	}
+}
+
+// Wrap f as a QueueJobFunction. A nil f stays nil.
+func batchJobFunction(f QueueBatchFunction) QueueJobFunction {
+	if f == nil {
+		return nil
+	}
+	return func(ctx context.Context, jobs []*Job) [][]byte {
+		names := make([][]byte, len(jobs))
+		data := make([][][]byte, len(jobs))
+		for i, job := range jobs {
+			names[i] = job.Name
+			data[i] = job.Data
+		}
+		return f(names, data)
+	}
+}
+
+// Run f on one element, returning its result, or the results of its data
+// items if f sets them
+func runJob(ctx context.Context, f QueueJobFunction, name []byte, data [][]byte, metadata map[string]string) ([]byte, [][]byte, error) {
+	job := &Job{Name: name, Data: data, Metadata: metadata}
+	results := f(ctx, []*Job{job})
+	if job.Results != nil {
+		return nil, job.Results, nil
+	}
+	if len(results) == 0 {
+		return nil, nil, ErrNoResult
+	}
+	return results[0], nil, nil
+}
+
 type QueueErrFunction func(name []byte, err interface{})
 
 func defaultErrFunc(name []byte, err interface{}) {
 	log.Println("Error in queue on element:", name, "-", err)
 }
 
+// An element which finished after its deadline
+type DeadlineMiss struct {
+	Name     []byte
+	Deadline time.Time
+	Started  time.Time
+	Finished time.Time
+}
+
+// Whether the element had already missed its deadline when it started
+func (M DeadlineMiss) StartedLate() bool { return M.Started.After(M.Deadline) }
+
+type QueueDeadlineMissFunction func(miss DeadlineMiss)
+
+// Aggregate deadline statistics of a queue
+type DeadlineStats struct {
+	Finished      int           // Number of elements with deadlines which have finished
+	StartedLate   int           // Number of those which started after their deadline
+	FinishedLate  int           // Number of those which finished after their deadline
+	TotalLateness time.Duration // Sum of how far past their deadlines the late elements finished
+	MaxLateness   time.Duration // The furthest past its deadline an element has finished
+}
+
+// Add a finished element to the statistics, returning whether it missed its deadline
+func (S *DeadlineStats) add(miss DeadlineMiss) bool {
+	S.Finished++
+	if miss.StartedLate() {
+		S.StartedLate++
+	}
+	lateness := miss.Finished.Sub(miss.Deadline)
+	if lateness <= 0 {
+		return false
+	}
+	S.FinishedLate++
+	S.TotalLateness += lateness
+	if lateness > S.MaxLateness {
+		S.MaxLateness = lateness
+	}
+	return true
+}
+
+// Total size of data in bytes
+func dataSize(data [][]byte) int {
+	n := 0
+	for _, d := range data {
+		n += len(d)
+	}
+	return n
+}
+
+// Merge metadata into the metadata of an element. Data added to an element
+// later replaces the values of the same keys added earlier.
+func mergeMetadata(into, metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return into
+	}
+	if into == nil {
+		into = make(map[string]string, len(metadata))
+	}
+	maps.Copy(into, metadata)
+	return into
+}
+
+// Matches names which begin with prefix
+func MatchPrefix(prefix []byte) func(name []byte) bool {
+	return func(name []byte) bool { return bytes.HasPrefix(name, prefix) }
+}
+
+// The result of a finished element, or of one add call to an element run with
+// an item function. Err is set if it failed, such as with ErrNoResult or
+// ErrPanicked.
+type Completion struct {
+	Value []byte
+	Err   error
+}
+
+// Names and results of finished elements, collected for an iterator
+type completions struct {
+	lock    sync.Mutex
+	names   [][]byte
+	results []Completion
+	ready   chan struct{} // Signaled once there are results to take
+}
+
+func newCompletions() *completions {
+	return &completions{ready: make(chan struct{}, 1)}
+}
+
+// Add the results of a finished element, without blocking
+func (C *completions) add(name []byte, results []Completion) {
+	C.lock.Lock()
+	for _, r := range results {
+		C.names = append(C.names, name)
+		C.results = append(C.results, r)
+	}
+	C.lock.Unlock()
+	select {
+	case C.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take all results added so far
+func (C *completions) take() ([][]byte, []Completion) {
+	C.lock.Lock()
+	defer C.lock.Unlock()
+	names, results := C.names, C.results
+	C.names, C.results = nil, nil
+	return names, results
+}
+
+// Lifecycle state of a queue
+type State int
+
+const (
+	StateNew      State = iota // Not yet run
+	StateRunning               // Executing elements
+	StatePaused                // Running, but not starting any elements
+	StateStopping              // Stopped, and waiting for executing elements to finish
+	StateStopped               // Stopped, with no elements executing
+	StateClosed                // Closed, with no elements left to execute
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "New"
+	case StateRunning:
+		return "Running"
+	case StatePaused:
+		return "Paused"
+	case StateStopping:
+		return "Stopping"
+	case StateStopped:
+		return "Stopped"
+	case StateClosed:
+		return "Closed"
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Names of the elements handled while shutting down a queue
+type ShutdownReport struct {
+	Completed [][]byte // Finished executing during the shutdown
+	Canceled  [][]byte // Were still waiting, and removed from the queue
+	Running   [][]byte // Were still executing once the shutdown finished
+}
+
 // Map Queue to SAPIPQueue
 type Queue SAPIPQueue
 
@@ -59,19 +722,84 @@ type IndexedElements struct {
 	NameIndex map[string]*Element // Map from each name to pointer to corresponding element
 	Front     *Element            // Front element
 	End       *Element            // Last element
+	bytes     int                 // Total size of the data of all elements in bytes
+	maxData   int                 // Maximum number of data items in each element, or 0 for no maximum
 }
 
 func MakeIndexedElements() IndexedElements {
-	return IndexedElements{make(map[string]*Element, 0), nil, nil}
+	return IndexedElements{make(map[string]*Element), nil, nil, 0, 0}
+}
+
+// Total size of the data of all elements in bytes
+func (D *IndexedElements) Bytes() int {
+	return D.bytes
 }
 
-// Insert an element
+// Insert an element, returning the result of this call's contribution to it
 func (D *IndexedElements) AddElement(Name []byte, Data ...[]byte) SafeReturn {
-	if p, ok := D.NameIndex[string(Name)]; ok {
-		p.Data = append(p.Data, Data...)
-		return p.OutChannel
+	return D.AddElementWithMetadata(Name, nil, Data...)
+}
+
+// Insert an element as with AddElement, merging Metadata into its metadata
+func (D *IndexedElements) AddElementWithMetadata(Name []byte, Metadata map[string]string, Data ...[]byte) SafeReturn {
+	return D.insert(Name, Metadata, Data, nil)
+}
+
+// Insert an element, recording c as the contribution of the data if it is
+// not nil. Returns the channel of c, or else the OutChannel of the element
+// (or follow-on chunk) holding the last of the data.
+func (D *IndexedElements) insert(Name []byte, Metadata map[string]string, Data [][]byte, c *contribution) SafeReturn {
+	now := time.Now()
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		p = &Element{Name: Name, OutChannel: make(SafeReturn, 1), added: now}
+		D.add(p)
+	}
+	// Append the data, continuing into follow-on chunks once the last is full
+	e := p.lastChunk()
+	for {
+		n := len(Data)
+		if D.maxData > 0 && len(e.Data)+n > D.maxData {
+			n = max(D.maxData-len(e.Data), 0)
+		}
+		size := dataSize(Data[:n])
+		start := len(e.Data)
+		e.Data = append(e.Data, Data[:n]...)
+		e.size += size
+		e.updated = now
+		D.bytes += size
+		Data = Data[n:]
+		if len(Data) == 0 {
+			e.Metadata = mergeMetadata(e.Metadata, Metadata)
+			if c == nil {
+				e.untracked = true
+				return e.OutChannel
+			}
+			c.start, c.items = start, n
+			e.callers = append(e.callers, *c)
+			if c.out == nil {
+				return e.OutChannel
+			}
+			return c.out
+		}
+		// The result is returned by the chunk holding the last of the data
+		if n > 0 {
+			e.Metadata = mergeMetadata(e.Metadata, Metadata)
+			if c == nil {
+				e.untracked = true
+			} else {
+				partial := *c
+				partial.start, partial.items, partial.partial = start, n, true
+				e.callers = append(e.callers, partial)
+			}
+		}
+		e = &Element{Name: Name, OutChannel: make(SafeReturn, 1), added: now}
+		p.chunks = append(p.chunks, e)
 	}
-	e := &Element{Name, Data, make(SafeReturn, 1), nil, nil}
+}
+
+// Insert e at the end
+func (D *IndexedElements) add(e *Element) {
 	if D.End != nil {
 		D.End.Next = e
 		e.Prev = D.End
@@ -81,11 +809,145 @@ func (D *IndexedElements) AddElement(Name []byte, Data ...[]byte) SafeReturn {
 	}
 	D.End = e
 	D.NameIndex[string(e.Name)] = e
-	return e.OutChannel
+}
+
+// Put the first follow-on chunk of e into the queue in place of e, before
+// next, the element which followed e
+func (D *IndexedElements) promote(e, next *Element) {
+	if len(e.chunks) == 0 {
+		return
+	}
+	c := e.chunks[0]
+	c.chunks = e.chunks[1:]
+	e.chunks = nil
+	D.insertBefore(c, next)
+	D.NameIndex[string(c.Name)] = c
+}
+
+// The element which further data for the name is appended to, if there is room in it
+func (D *IndexedElements) receiver(Name []byte) *Element {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return nil
+	}
+	e := p.lastChunk()
+	if D.maxData > 0 && len(e.Data) >= D.maxData {
+		return nil
+	}
+	return e
+}
+
+// Remove an element along with its follow-on chunks, and return them all
+func (D *IndexedElements) drop(e *Element) []*Element {
+	chunks := e.chunks
+	e.chunks = nil
+	D.RemoveElement(e)
+	for _, c := range chunks {
+		D.bytes -= c.size
+	}
+	return append([]*Element{e}, chunks...)
+}
+
+// Withdraw the data added with r from the waiting element of the name, and
+// fail r with ErrWithdrawn. The element (or follow-on chunk) is removed once
+// it has no data left. Returns whether any data was withdrawn.
+func (D *IndexedElements) withdraw(Name []byte, r *result) bool {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	withdrawn := false
+	chunks := p.chunks[:0]
+	for _, c := range p.chunks {
+		size, found := c.withdraw(r)
+		D.bytes -= size
+		withdrawn = withdrawn || found
+		if found && len(c.callers) == 0 && !c.untracked {
+			c.failAll(ErrWithdrawn)
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	p.chunks = chunks
+	size, found := p.withdraw(r)
+	D.bytes -= size
+	withdrawn = withdrawn || found
+	if found && len(p.callers) == 0 && !p.untracked {
+		D.RemoveElement(p)
+		p.failAll(ErrWithdrawn)
+	}
+	if withdrawn {
+		Handle{r}.resolve(nil, ErrWithdrawn)
+	}
+	return withdrawn
+}
+
+// Whether data whose waiters are w is waiting in the element of the name
+func (D *IndexedElements) holds(Name []byte, w *watchers) bool {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	for _, e := range append([]*Element{p}, p.chunks...) {
+		for _, c := range e.callers {
+			if c.waiters == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Remove the waiting element (and follow-on chunks) of the name which no
+// longer have any waiters, failing them with ErrAbandoned. Returns whether
+// any were removed.
+func (D *IndexedElements) dropAbandoned(Name []byte) bool {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	dropped := false
+	chunks := p.chunks[:0]
+	for _, c := range p.chunks {
+		if c.abandoned() {
+			D.bytes -= c.size
+			c.failAll(ErrAbandoned)
+			dropped = true
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	p.chunks = chunks
+	if p.abandoned() {
+		D.RemoveElement(p)
+		p.failAll(ErrAbandoned)
+		dropped = true
+	}
+	return dropped
+}
+
+// The elements whose names match, in order, without follow-on chunks
+func (D *IndexedElements) matching(match func(name []byte) bool) []*Element {
+	var r []*Element
+	for e := D.Front; e != nil; e = e.Next {
+		if match(e.Name) {
+			r = append(r, e)
+		}
+	}
+	return r
 }
 
 // Remove an element
 func (D *IndexedElements) RemoveElement(e *Element) {
+	next := e.Next
+	D.unlink(e)
+	delete(D.NameIndex, string(e.Name))
+	D.bytes -= e.size
+	D.promote(e, next)
+}
+
+// Remove e from the order, leaving the index intact
+func (D *IndexedElements) unlink(e *Element) {
 	if e.Prev != nil {
 		e.Prev.Next = e.Next
 	}
@@ -100,12 +962,71 @@ func (D *IndexedElements) RemoveElement(e *Element) {
 	}
 	e.Next = nil
 	e.Prev = nil
-	delete(D.NameIndex, string(e.Name))
 }
 
-// Remove the front element
+// Insert e into the order before x, or at the end if x is nil
+func (D *IndexedElements) insertBefore(e, x *Element) {
+	if x == nil {
+		e.Prev = D.End
+		if D.End != nil {
+			D.End.Next = e
+		} else {
+			D.Front = e
+		}
+		D.End = e
+		return
+	}
+	e.Next = x
+	e.Prev = x.Prev
+	if x.Prev != nil {
+		x.Prev.Next = e
+	} else {
+		D.Front = e
+	}
+	x.Prev = e
+}
+
+// Move the element of the name to the front. Returns false if there is none.
+func (D *IndexedElements) MoveToFront(Name []byte) bool {
+	e, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	D.unlink(e)
+	D.insertBefore(e, D.Front)
+	return true
+}
+
+// Move the element of the name to the end. Returns false if there is none.
+func (D *IndexedElements) MoveToBack(Name []byte) bool {
+	e, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	D.unlink(e)
+	D.insertBefore(e, nil)
+	return true
+}
+
+// Move the element of the name to just before the element of other.
+// Returns false if either is missing, or they are the same.
+func (D *IndexedElements) MoveBefore(Name, Other []byte) bool {
+	e, ok := D.NameIndex[string(Name)]
+	o, ok2 := D.NameIndex[string(Other)]
+	if !ok || !ok2 || e == o {
+		return false
+	}
+	D.unlink(e)
+	D.insertBefore(e, o)
+	return true
+}
+
+// Remove the front element, or return nil if there are none
 func (D *IndexedElements) Pop() *Element {
 	e := D.Front
+	if e == nil {
+		return nil
+	}
 	if e.Next != nil {
 		e.Next.Prev = nil
 	}
@@ -116,57 +1037,130 @@ func (D *IndexedElements) Pop() *Element {
 	e.Next = nil
 	e.Prev = nil
 	delete(D.NameIndex, string(e.Name))
+	D.bytes -= e.size
+	D.promote(e, D.Front)
 	return e
 }
 
-// Removes all elements into a slice
+// Removes all elements into a slice, including follow-on chunks, and fails
+// them with ErrDropped, releasing anything waiting on them
 // Equivalent to appending all D.Pop() values into an array
 func (D *IndexedElements) DumpElements() []*Element {
+	r := D.dump()
+	for _, e := range r {
+		e.failAll(ErrDropped)
+	}
+	return r
+}
+
+// Removes all elements into a slice, including follow-on chunks, without
+// resolving them
+func (D *IndexedElements) dump() []*Element {
 	r := make([]*Element, 0, len(D.NameIndex))
 	for _, v := range D.NameIndex {
-		r = append(r, v)
+		r = append(append(r, v), v.chunks...)
+		v.chunks = nil
 	}
 	D.NameIndex = make(map[string]*Element)
 	D.Front = nil
 	D.End = nil
+	D.bytes = 0
 	return r
 }
 
-type IndexedPriorityElements struct {
-	NameIndex      map[string]*PriorityElement // Map from each name to pointer to corresponding element
-	PriorityMap    map[int]*PriorityElement    // Map from each priority to the element which is at the end of that priority
-	Priorities     []int                       // List of priorities in sorted order
-	PriorityLength map[int]int                 // Map from each priority to the number of elements which have the priority
-	Front          *PriorityElement            // Front element
+// Removes all elements in the order they would be popped, including
+// follow-on chunks, fails them with ErrDropped, releasing anything waiting
+// on them, and returns them
+func (D *IndexedElements) Drain() []*Element {
+	r := D.drain()
+	for _, e := range r {
+		e.failAll(ErrDropped)
+	}
+	return r
+}
+
+// Removes all elements in the order they would be popped, including
+// follow-on chunks, without resolving them
+func (D *IndexedElements) drain() []*Element {
+	r := make([]*Element, 0, len(D.NameIndex))
+	for D.Front != nil {
+		r = append(r, D.Pop())
+	}
+	return r
+}
+
+// Returns copies of all elements in the order they would be popped,
+// including follow-on chunks, leaving D unchanged
+func (D *IndexedElements) Snapshot() []*Element {
+	// Pop copies of the elements from a copy of D
+	C := MakeIndexedElements()
+	for e := D.Front; e != nil; e = e.Next {
+		c := e.copy()
+		for _, chunk := range e.chunks {
+			c.chunks = append(c.chunks, chunk.copy())
+		}
+		C.add(c)
+	}
+	return C.drain()
+}
+
+type IndexedPriorityElementsOf[P comparable] struct {
+	NameIndex      map[string]*PriorityElementOf[P] // Map from each name to pointer to corresponding element
+	PriorityMap    map[P]*PriorityElementOf[P]      // Map from each priority to the element which is at the end of that priority
+	Priorities     []P                              // List of priorities in sorted order
+	PriorityLength map[P]int                        // Map from each priority to the number of elements which have the priority
+	Front          *PriorityElementOf[P]            // Front element
+	Oldest         *PriorityElementOf[P]            // Element which has been waiting the longest
+	Newest         *PriorityElementOf[P]            // Element which was most recently enqueued
+	less           func(a, b P) bool                // Ordering of the priorities
+	bytes          int                              // Total size of the data of all elements in bytes
+	maxData        int                              // Maximum number of data items in each element, or 0 for no maximum
 }
 
+// Indexed elements with int priorities, where smaller priorities go first
+type IndexedPriorityElements = IndexedPriorityElementsOf[int]
+
 func MakeIndexedPriorityElements() IndexedPriorityElements {
-	return IndexedPriorityElements{make(map[string]*PriorityElement, 0), make(map[int]*PriorityElement, 0), make([]int, 0), make(map[int]int, 0), nil}
+	return MakeIndexedPriorityElementsOf(cmp.Less[int])
+}
+
+// Make indexed elements ordered by less, which reports whether priority a goes before priority b.
+// Elements whose priorities are equal (==) go in the order they were added, and a
+// new priority ordered equally to existing ones (neither is less) goes after them.
+func MakeIndexedPriorityElementsOf[P comparable](less func(a, b P) bool) IndexedPriorityElementsOf[P] {
+	return IndexedPriorityElementsOf[P]{make(map[string]*PriorityElementOf[P]), make(map[P]*PriorityElementOf[P]), make([]P, 0), make(map[P]int), nil, nil, nil, less, 0, 0}
 }
 
-func (D *IndexedPriorityElements) addPriority(Priority int) int {
+// Total size of the data of all elements in bytes
+func (D *IndexedPriorityElementsOf[P]) Bytes() int {
+	return D.bytes
+}
+
+func (D *IndexedPriorityElementsOf[P]) addPriority(Priority P) int {
 	// Binary search to determine the index to insert Priority
 	i := 0
 	j := len(D.Priorities)
 	for i < j {
 		h := (i + j) >> 1
-		if D.Priorities[h] < Priority {
+		// Go after the priorities which are ordered equally, so that their elements run first
+		if !D.less(Priority, D.Priorities[h]) {
 			i = h + 1
 		} else {
 			j = h
 		}
 	}
 	// Insert it
-	D.Priorities = append(D.Priorities[:i], append([]int{Priority}, D.Priorities[i:]...)...)
+	D.Priorities = append(D.Priorities[:i], append([]P{Priority}, D.Priorities[i:]...)...)
 	// Return the index
 	return i
 }
 
-func (D *IndexedPriorityElements) add(e *PriorityElement) {
+func (D *IndexedPriorityElementsOf[P]) add(e *PriorityElementOf[P]) {
 	if a, ok := D.PriorityMap[e.Priority]; ok {
 		// If we already have the priority, all we need to do is put the new element at the end
 		if a.Next != nil {
 			e.Next = a.Next
+			a.Next.Prev = e
 		}
 		a.Next = e
 		e.Prev = a
@@ -174,15 +1168,21 @@ func (D *IndexedPriorityElements) add(e *PriorityElement) {
 	} else {
 		// Otherwise we need to create a new priority
 		i := D.addPriority(e.Priority)
-		// i is the number of priorities > e.Priority
+		// i is the number of priorities before e.Priority
 		if i == 0 {
 			// e has the smallest priority and goes to the front
 			e.Next = D.Front
+			if D.Front != nil {
+				D.Front.Prev = e
+			}
 			D.Front = e
 		} else {
 			// e Needs to be placed between two priorities
 			x := D.PriorityMap[D.Priorities[i-1]]
 			e.Next = x.Next
+			if x.Next != nil {
+				x.Next.Prev = e
+			}
 			x.Next = e
 			e.Prev = x
 		}
@@ -193,29 +1193,287 @@ func (D *IndexedPriorityElements) add(e *PriorityElement) {
 	D.NameIndex[string(e.Name)] = e
 }
 
-// Insert an element
-func (D *IndexedPriorityElements) AddElement(Name, Data []byte, Priority int) SafeReturn {
+// Insert an element, returning the result of this call's contribution to it
+func (D *IndexedPriorityElementsOf[P]) AddElement(Name, Data []byte, Priority P) SafeReturn {
+	return D.AddElementWithMetadata(Name, Data, Priority, nil)
+}
+
+// Insert an element as with AddElement, merging Metadata into its metadata
+func (D *IndexedPriorityElementsOf[P]) AddElementWithMetadata(Name, Data []byte, Priority P, Metadata map[string]string) SafeReturn {
+	return D.insert(Name, Data, Priority, Metadata, nil)
+}
+
+// Insert an element, recording c as the contribution of the data if it is
+// not nil. Returns the channel of c, or else the OutChannel of the element
+// (or follow-on chunk) holding the data.
+func (D *IndexedPriorityElementsOf[P]) insert(Name, Data []byte, Priority P, Metadata map[string]string, c *contribution) SafeReturn {
+	now := time.Now()
+	D.bytes += len(Data)
 	// If the element name is already in the queue we need to do special stuff
 	if p, ok := D.NameIndex[string(Name)]; ok {
-		// Append the data
-		p.Data = append(p.Data, Data)
-		// If the new priority is smaller, we need to remove the old element and insert it with the new priority
-		if p.Priority > Priority {
-			// Note to self: Possibility of memory leak in re-using p.Data/p.OutChannel?
-			e := &PriorityElement{Name, p.Data, Priority, p.OutChannel, nil, nil}
-			D.RemoveElement(p)
-			D.add(e)
+		// If the new priority goes first, we need to move the element to the new priority
+		// It keeps its place in the age order, since it has been waiting since it was first added
+		if D.less(Priority, p.Priority) {
+			D.unlink(p)
+			p.Priority = Priority
+			D.add(p)
+			for _, c := range p.chunks {
+				if D.less(Priority, c.Priority) {
+					c.Priority = Priority
+				}
+			}
 		}
-		return p.OutChannel
+		// Append the data, to a new follow-on chunk if the last is full
+		e := p.lastChunk()
+		if D.maxData > 0 && len(e.Data) >= D.maxData {
+			e = &PriorityElementOf[P]{Name: Name, Priority: Priority, OutChannel: make(SafeReturn, 1), Added: now}
+			p.chunks = append(p.chunks, e)
+		}
+		e.Data = append(e.Data, Data)
+		e.Metadata = mergeMetadata(e.Metadata, Metadata)
+		e.size += len(Data)
+		e.updated = now
+		return e.record(c, len(e.Data)-1)
 	}
 	// Go ahead and insert the element
-	e := &PriorityElement{Name, [][]byte{Data}, Priority, make(SafeReturn, 1), nil, nil}
+	e := &PriorityElementOf[P]{Name: Name, Data: [][]byte{Data}, Priority: Priority, OutChannel: make(SafeReturn, 1), Added: now, size: len(Data), updated: now}
+	e.Metadata = mergeMetadata(nil, Metadata)
 	D.add(e)
-	return e.OutChannel
+	D.addAge(e)
+	return e.record(c, 0)
+}
+
+// Put the first follow-on chunk of e into the queue in place of e, before
+// next, the element which followed e. A chunk of another priority goes to the
+// end of that priority instead.
+func (D *IndexedPriorityElementsOf[P]) promote(e, next *PriorityElementOf[P]) {
+	if len(e.chunks) == 0 {
+		return
+	}
+	c := e.chunks[0]
+	c.chunks = e.chunks[1:]
+	e.chunks = nil
+	if c.Priority == e.Priority && next != nil && next.Priority == e.Priority {
+		D.insertBefore(c, next)
+		D.NameIndex[string(c.Name)] = c
+	} else {
+		D.add(c)
+	}
+	D.addAge(c)
+}
+
+// The element which further data for the name is appended to, if there is room in it
+func (D *IndexedPriorityElementsOf[P]) receiver(Name []byte) *PriorityElementOf[P] {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return nil
+	}
+	e := p.lastChunk()
+	if D.maxData > 0 && len(e.Data) >= D.maxData {
+		return nil
+	}
+	return e
+}
+
+// Remove an element along with its follow-on chunks, and return them all
+func (D *IndexedPriorityElementsOf[P]) drop(e *PriorityElementOf[P]) []*PriorityElementOf[P] {
+	chunks := e.chunks
+	e.chunks = nil
+	D.RemoveElement(e)
+	for _, c := range chunks {
+		D.bytes -= c.size
+	}
+	return append([]*PriorityElementOf[P]{e}, chunks...)
+}
+
+// The element which would run last
+func (D *IndexedPriorityElementsOf[P]) last() *PriorityElementOf[P] {
+	if len(D.Priorities) == 0 {
+		return nil
+	}
+	return D.PriorityMap[D.Priorities[len(D.Priorities)-1]]
+}
+
+// Insert e into the age order. New elements go at the end.
+func (D *IndexedPriorityElementsOf[P]) addAge(e *PriorityElementOf[P]) {
+	x := D.Newest
+	for x != nil && x.Added.After(e.Added) {
+		x = x.Older
+	}
+	if x != nil {
+		e.Newer = x.Newer
+		x.Newer = e
+	} else {
+		e.Newer = D.Oldest
+		D.Oldest = e
+	}
+	e.Older = x
+	if e.Newer != nil {
+		e.Newer.Older = e
+	} else {
+		D.Newest = e
+	}
+}
+
+// Re-insert an element which was taken out to execute, such as a preempted element.
+// If an element of the same name has been added since, they are merged.
+func (D *IndexedPriorityElementsOf[P]) requeue(e *PriorityElementOf[P]) {
+	D.bytes += e.size
+	p, ok := D.NameIndex[string(e.Name)]
+	if ok && (D.maxData <= 0 || len(e.Data)+len(p.Data) <= D.maxData) {
+		// The older data goes first, and copying it leaves e.Data untouched
+		p.Data = append(append(make([][]byte, 0, len(e.Data)+len(p.Data)), e.Data...), p.Data...)
+		p.extra = append(append(p.extra, e.OutChannel), e.extra...)
+		callers := append(make([]contribution, 0, len(e.callers)+len(p.callers)), e.callers...)
+		for _, c := range p.callers {
+			c.start += len(e.Data)
+			callers = append(callers, c)
+		}
+		p.callers = callers
+		p.untracked = p.untracked || e.untracked
+		p.Metadata = mergeMetadata(mergeMetadata(nil, e.Metadata), p.Metadata)
+		p.size += e.size
+		if D.less(e.Priority, p.Priority) {
+			D.unlink(p)
+			p.Priority = e.Priority
+			D.add(p)
+		}
+		if e.Added.Before(p.Added) {
+			D.unlinkAge(p)
+			p.Added = e.Added
+			D.addAge(p)
+		}
+		return
+	}
+	n := &PriorityElementOf[P]{Name: e.Name, Data: append([][]byte(nil), e.Data...), Metadata: maps.Clone(e.Metadata), Priority: e.Priority, OutChannel: e.OutChannel, Added: e.Added, extra: e.extra, callers: e.callers, untracked: e.untracked, size: e.size, updated: e.updated}
+	if ok {
+		// There is too much data to merge, so e goes first, followed on by p
+		D.unlink(p)
+		D.unlinkAge(p)
+		n.chunks = append([]*PriorityElementOf[P]{p}, p.chunks...)
+		p.chunks = nil
+	}
+	D.add(n)
+	D.addAge(n)
+}
+
+// Withdraw the data added with r from the waiting element of the name, and
+// fail r with ErrWithdrawn. The element (or follow-on chunk) is removed once
+// it has no data left. Returns whether any data was withdrawn.
+func (D *IndexedPriorityElementsOf[P]) withdraw(Name []byte, r *result) bool {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	withdrawn := false
+	chunks := p.chunks[:0]
+	for _, c := range p.chunks {
+		size, found := c.withdraw(r)
+		D.bytes -= size
+		withdrawn = withdrawn || found
+		if found && len(c.callers) == 0 && !c.untracked {
+			c.failAll(ErrWithdrawn)
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	p.chunks = chunks
+	size, found := p.withdraw(r)
+	D.bytes -= size
+	withdrawn = withdrawn || found
+	if found && len(p.callers) == 0 && !p.untracked {
+		D.RemoveElement(p)
+		p.failAll(ErrWithdrawn)
+	}
+	if withdrawn {
+		Handle{r}.resolve(nil, ErrWithdrawn)
+	}
+	return withdrawn
+}
+
+// Whether data whose waiters are w is waiting in the element of the name
+func (D *IndexedPriorityElementsOf[P]) holds(Name []byte, w *watchers) bool {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	for _, e := range append([]*PriorityElementOf[P]{p}, p.chunks...) {
+		for _, c := range e.callers {
+			if c.waiters == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Remove the waiting element (and follow-on chunks) of the name which no
+// longer have any waiters, failing them with ErrAbandoned. Returns whether
+// any were removed.
+func (D *IndexedPriorityElementsOf[P]) dropAbandoned(Name []byte) bool {
+	p, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	dropped := false
+	chunks := p.chunks[:0]
+	for _, c := range p.chunks {
+		if c.abandoned() {
+			D.bytes -= c.size
+			c.failAll(ErrAbandoned)
+			dropped = true
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	p.chunks = chunks
+	if p.abandoned() {
+		D.RemoveElement(p)
+		p.failAll(ErrAbandoned)
+		dropped = true
+	}
+	return dropped
+}
+
+// The elements whose names match, in order, without follow-on chunks
+func (D *IndexedPriorityElementsOf[P]) matching(match func(name []byte) bool) []*PriorityElementOf[P] {
+	var r []*PriorityElementOf[P]
+	for e := D.Front; e != nil; e = e.Next {
+		if match(e.Name) {
+			r = append(r, e)
+		}
+	}
+	return r
 }
 
 // Remove an element
-func (D *IndexedPriorityElements) RemoveElement(e *PriorityElement) {
+func (D *IndexedPriorityElementsOf[P]) RemoveElement(e *PriorityElementOf[P]) {
+	next := e.Next
+	D.unlink(e)
+	D.unlinkAge(e)
+	delete(D.NameIndex, string(e.Name))
+	D.bytes -= e.size
+	D.promote(e, next)
+}
+
+// Remove e from the age order
+func (D *IndexedPriorityElementsOf[P]) unlinkAge(e *PriorityElementOf[P]) {
+	if e.Older != nil {
+		e.Older.Newer = e.Newer
+	} else {
+		D.Oldest = e.Newer
+	}
+	if e.Newer != nil {
+		e.Newer.Older = e.Older
+	} else {
+		D.Newest = e.Older
+	}
+	e.Newer = nil
+	e.Older = nil
+}
+
+// Remove e from the priority order, leaving the indexes and age order intact
+func (D *IndexedPriorityElementsOf[P]) unlink(e *PriorityElementOf[P]) {
 	// First, reorder the pointers
 	if e.Prev != nil {
 		e.Prev.Next = e.Next
@@ -228,19 +1486,7 @@ func (D *IndexedPriorityElements) RemoveElement(e *PriorityElement) {
 	}
 	if D.PriorityLength[e.Priority] == 1 {
 		// e is the only element of that priority, so we need to delete the priority
-		// Start with a binary search to determine the index of the priority
-		// Note to self: This might just be faster as a linear search. How many distinct priorities will there be?
-		i := 0
-		j := len(D.Priorities)
-		for i < j {
-			h := (i + j) >> 1
-			if D.Priorities[h] < e.Priority {
-				i = h + 1
-			} else {
-				j = h
-			}
-		}
-		// And delete the priority
+		i := D.priorityIndex(e.Priority)
 		D.Priorities = append(D.Priorities[:i], D.Priorities[i+1:]...)
 		delete(D.PriorityMap, e.Priority)
 		delete(D.PriorityLength, e.Priority)
@@ -254,12 +1500,112 @@ func (D *IndexedPriorityElements) RemoveElement(e *PriorityElement) {
 	// Clear the pointers of e
 	e.Next = nil
 	e.Prev = nil
-	delete(D.NameIndex, string(e.Name))
 }
 
-// Remove the front element
-func (D *IndexedPriorityElements) Pop() *PriorityElement {
+// The index of Priority in D.Priorities, which must contain it
+func (D *IndexedPriorityElementsOf[P]) priorityIndex(Priority P) int {
+	// Start with a binary search to determine the index of the priority
+	// Note to self: This might just be faster as a linear search. How many distinct priorities will there be?
+	i := 0
+	j := len(D.Priorities)
+	for i < j {
+		h := (i + j) >> 1
+		if D.less(D.Priorities[h], Priority) {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	// Distinct priorities may be ordered equally (such as equal times in
+	// different locations), so step forward to the exact priority
+	for D.Priorities[i] != Priority {
+		i++
+	}
+	return i
+}
+
+// The first element of Priority, which must have elements
+func (D *IndexedPriorityElementsOf[P]) first(Priority P) *PriorityElementOf[P] {
+	i := D.priorityIndex(Priority)
+	if i == 0 {
+		return D.Front
+	}
+	return D.PriorityMap[D.Priorities[i-1]].Next
+}
+
+// Insert e into the priority order before x, taking on the priority of x
+func (D *IndexedPriorityElementsOf[P]) insertBefore(e, x *PriorityElementOf[P]) {
+	e.Priority = x.Priority
+	e.Next = x
+	e.Prev = x.Prev
+	if x.Prev != nil {
+		x.Prev.Next = e
+	} else {
+		D.Front = e
+	}
+	x.Prev = e
+	D.PriorityLength[x.Priority] += 1
+}
+
+// Move the element of the name to the front of its priority.
+// Returns false if there is none.
+func (D *IndexedPriorityElementsOf[P]) MoveToFront(Name []byte) bool {
+	e, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	if f := D.first(e.Priority); f != e {
+		D.unlink(e)
+		D.insertBefore(e, f)
+	}
+	return true
+}
+
+// Set the priority of e and its follow-on chunks, moving e to the end of it
+func (D *IndexedPriorityElementsOf[P]) setPriority(e *PriorityElementOf[P], Priority P) {
+	D.unlink(e)
+	e.Priority = Priority
+	D.add(e)
+	for _, c := range e.chunks {
+		c.Priority = Priority
+	}
+}
+
+// Move the element of the name to the end of its priority.
+// Returns false if there is none.
+func (D *IndexedPriorityElementsOf[P]) MoveToBack(Name []byte) bool {
+	e, ok := D.NameIndex[string(Name)]
+	if !ok {
+		return false
+	}
+	D.unlink(e)
+	D.add(e)
+	return true
+}
+
+// Move the element of the name to just before the element of other, taking
+// on its priority along with its follow-on chunks. Returns false if either
+// is missing, or they are the same.
+func (D *IndexedPriorityElementsOf[P]) MoveBefore(Name, Other []byte) bool {
+	e, ok := D.NameIndex[string(Name)]
+	o, ok2 := D.NameIndex[string(Other)]
+	if !ok || !ok2 || e == o {
+		return false
+	}
+	D.unlink(e)
+	D.insertBefore(e, o)
+	for _, c := range e.chunks {
+		c.Priority = e.Priority
+	}
+	return true
+}
+
+// Remove the front element, or return nil if there are none
+func (D *IndexedPriorityElementsOf[P]) Pop() *PriorityElementOf[P] {
 	e := D.Front
+	if e == nil {
+		return nil
+	}
 	// Set the front to the next element and clear the next element's pointer to e
 	if e.Next != nil {
 		e.Next.Prev = nil
@@ -277,20 +1623,92 @@ func (D *IndexedPriorityElements) Pop() *PriorityElement {
 	e.Next = nil
 	e.Prev = nil
 	// Remove e
+	D.unlinkAge(e)
 	delete(D.NameIndex, string(e.Name))
+	D.bytes -= e.size
+	D.promote(e, D.Front)
 	return e
 }
 
-// Removes all elements into a slice
+// Removes all elements into a slice, including follow-on chunks, and fails
+// them with ErrDropped, releasing anything waiting on them
 // Equivalent to appending all D.Pop() values into an array
-func (D *IndexedPriorityElements) DumpElements() []*PriorityElement {
-	r := make([]*PriorityElement, 0, len(D.NameIndex))
+func (D *IndexedPriorityElementsOf[P]) DumpElements() []*PriorityElementOf[P] {
+	r := D.dump()
+	for _, e := range r {
+		e.failAll(ErrDropped)
+	}
+	return r
+}
+
+// Removes all elements into a slice, including follow-on chunks, without
+// resolving them
+func (D *IndexedPriorityElementsOf[P]) dump() []*PriorityElementOf[P] {
+	r := make([]*PriorityElementOf[P], 0, len(D.NameIndex))
 	for _, v := range D.NameIndex {
-		r = append(r, v)
+		r = append(append(r, v), v.chunks...)
+		v.chunks = nil
 	}
-	D.NameIndex = make(map[string]*PriorityElement)
-	D.PriorityMap = make(map[int]*PriorityElement)
-	D.Priorities = make([]int, 0)
+	D.NameIndex = make(map[string]*PriorityElementOf[P])
+	D.PriorityMap = make(map[P]*PriorityElementOf[P])
+	D.Priorities = make([]P, 0)
+	D.PriorityLength = make(map[P]int)
 	D.Front = nil
+	D.Oldest = nil
+	D.Newest = nil
+	D.bytes = 0
+	return r
+}
+
+// Removes all elements in the order they would be popped, including
+// follow-on chunks, fails them with ErrDropped, releasing anything waiting
+// on them, and returns them
+func (D *IndexedPriorityElementsOf[P]) Drain() []*PriorityElementOf[P] {
+	r := D.drain()
+	for _, e := range r {
+		e.failAll(ErrDropped)
+	}
+	return r
+}
+
+// Removes all elements in the order they would be popped, including
+// follow-on chunks, without resolving them
+func (D *IndexedPriorityElementsOf[P]) drain() []*PriorityElementOf[P] {
+	r := make([]*PriorityElementOf[P], 0, len(D.NameIndex))
+	for D.Front != nil {
+		r = append(r, D.Pop())
+	}
+	return r
+}
+
+// Returns copies of all elements in the order they would be popped,
+// including follow-on chunks, leaving D unchanged
+func (D *IndexedPriorityElementsOf[P]) Snapshot() []*PriorityElementOf[P] {
+	return D.snapshot(0)
+}
+
+// As Snapshot, but elements which have waited for at least maxWait are taken
+// first, oldest first, as the queues' aging policy does. Zero disables aging.
+func (D *IndexedPriorityElementsOf[P]) snapshot(maxWait time.Duration) []*PriorityElementOf[P] {
+	// Take copies of the elements from a copy of D
+	C := MakeIndexedPriorityElementsOf(D.less)
+	for e := D.Front; e != nil; e = e.Next {
+		c := e.copy()
+		for _, chunk := range e.chunks {
+			c.chunks = append(c.chunks, chunk.copy())
+		}
+		C.add(c)
+		C.addAge(c)
+	}
+	r := make([]*PriorityElementOf[P], 0, len(D.NameIndex))
+	now := time.Now()
+	for C.Front != nil {
+		if e := C.Oldest; maxWait > 0 && now.Sub(e.Added) >= maxWait && e != C.Front {
+			C.RemoveElement(e)
+			r = append(r, e)
+		} else {
+			r = append(r, C.Pop())
+		}
+	}
 	return r
 }